@@ -0,0 +1,59 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import "context"
+
+// Pending is an event published with PublishAsync, whose plugins may still be running
+type Pending struct {
+	m    *Manager
+	c    *collector
+	done chan struct{}
+}
+
+// Done returns a channel which is closed when all the plugins completed
+func (p *Pending) Done() <-chan struct{} {
+	return p.done
+}
+
+// Wait waits for all the plugins to complete, and returns their results
+// like PublishAndCollect does
+func (p *Pending) Wait() ([]PluginResult, error) {
+	<-p.done
+	return p.m.gather(p.c)
+}
+
+// PublishAsync publishes the event and returns without waiting for the plugins,
+// which run in parallel. Listeners bound with Response are called as each
+// plugin completes, and the returned Pending can be used to wait for all of them.
+func (m *Manager) PublishAsync(event EventType, obj interface{}) (*Pending, error) {
+	return m.PublishAsyncContext(context.Background(), event, obj)
+}
+
+// PublishAsyncContext is like PublishAsync, but the given context is propagated to the plugins
+func (m *Manager) PublishAsyncContext(ctx context.Context, event EventType, obj interface{}) (*Pending, error) {
+	ev, err := m.event(event, obj)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Pending{m: m, c: &collector{}, done: make(chan struct{})}
+	ev = ev.WithContext(ctx)
+	ev.results = p.c
+	go func() {
+		defer close(p.done)
+		m.emit(ev)
+	}()
+	return p, nil
+}
@@ -0,0 +1,75 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable_test
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "github.com/mudler/go-pluggable"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PublishAsync", func() {
+	Context("fanning out to multiple plugins", func() {
+		var temp string
+		var m *Manager
+
+		BeforeEach(func() {
+			var err error
+			temp, err = ioutil.TempDir("", "async")
+			Expect(err).Should(BeNil())
+
+			m = NewManager([]EventType{PackageInstalled})
+			for _, n := range []string{"a", "b", "c"} {
+				path := writePlugin(temp, n, "sleep 0.5\necho '{ \"state\": \"done\" }'")
+				m.Plugins = append(m.Plugins, Plugin{Name: n, Executable: path})
+			}
+			m.Register()
+		})
+
+		AfterEach(func() {
+			m.Close()
+			os.RemoveAll(temp)
+		})
+
+		It("runs the plugins in parallel", func() {
+			start := time.Now()
+			results, err := m.PublishAndCollect(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(results)).To(Equal(3))
+			Expect(time.Since(start)).To(BeNumerically("<", 1400*time.Millisecond))
+		})
+
+		It("returns before the plugins complete", func() {
+			start := time.Now()
+			p, err := m.PublishAsync(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically("<", 400*time.Millisecond))
+			Consistently(p.Done(), 200*time.Millisecond).ShouldNot(BeClosed())
+
+			results, err := p.Wait()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p.Done()).To(BeClosed())
+			Expect(len(results)).To(Equal(3))
+			for i, n := range []string{"a", "b", "c"} {
+				Expect(results[i].Plugin.Name).To(Equal(n))
+				Expect(results[i].Response.State).To(Equal("done"))
+			}
+		})
+	})
+})
@@ -0,0 +1,167 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// EventCircuitChanged is emitted on the Manager bus when the circuit of a plugin changes state
+const EventCircuitChanged EventType = "pluggable.circuit.changed"
+
+// ErrCircuitOpen is returned for plugins skipped because their circuit is open
+var ErrCircuitOpen = errors.New("plugin circuit is open")
+
+// CircuitState is the state of the circuit of a plugin
+type CircuitState string
+
+const (
+	// CircuitClosed plugins run normally
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen plugins are skipped until the cooldown expires
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen plugins are probed with a single event, which
+	// closes the circuit if it succeeds or opens it again otherwise
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// CircuitBreaker disables plugins which keep failing
+type CircuitBreaker struct {
+	// Threshold is the number of consecutive failures opening the circuit
+	Threshold int
+	// Cooldown is how long the circuit stays open before probing the plugin again
+	Cooldown time.Duration
+}
+
+type circuit struct {
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// Circuit returns the state of the circuit of the plugin
+func (m *Manager) Circuit(p Plugin) CircuitState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.circuits[p.id()]; ok {
+		return c.state
+	}
+	return CircuitClosed
+}
+
+// OnCircuitChange adds listeners called when the circuit of a plugin changes state
+func (m *Manager) OnCircuitChange(listener ...func(p *Plugin, s CircuitState)) *Manager {
+	for _, l := range listener {
+		m.on(string(EventCircuitChanged), l)
+	}
+	return m
+}
+
+// guard runs the plugin through its circuit, when the Manager has a CircuitBreaker
+func (m *Manager) guard(ctx context.Context, p Plugin, e Event) (EventResponse, error) {
+	if m.Breaker == nil || m.Breaker.Threshold <= 0 {
+		return m.retry(ctx, p, e)
+	}
+
+	if !m.allow(p) {
+		err := errors.Wrapf(ErrCircuitOpen, "skipping plugin %s", p.Name)
+		return EventResponse{Error: err.Error()}, err
+	}
+
+	resp, err := m.retry(ctx, p, e)
+	if errors.Is(err, ErrQueueFull) || resp.Unhandled() {
+		// The plugin didn't run, or didn't handle the event, so there is nothing to record
+		m.release(p)
+	} else {
+		m.record(p, err != nil || resp.Errored())
+	}
+	return resp, err
+}
+
+// allow tells if the plugin can run, half-opening its circuit once the cooldown expired
+func (m *Manager) allow(p Plugin) bool {
+	m.mu.Lock()
+	c, ok := m.circuits[p.id()]
+	if !ok {
+		m.mu.Unlock()
+		return true
+	}
+
+	switch c.state {
+	case CircuitOpen:
+		if time.Since(c.openedAt) < m.Breaker.Cooldown {
+			m.mu.Unlock()
+			return false
+		}
+		c.state = CircuitHalfOpen
+		c.probing = true
+		m.mu.Unlock()
+		m.Bus.Emit(string(EventCircuitChanged), &p, CircuitHalfOpen)
+		return true
+	case CircuitHalfOpen:
+		// Only one probe at a time
+		allowed := !c.probing
+		c.probing = true
+		m.mu.Unlock()
+		return allowed
+	}
+	m.mu.Unlock()
+	return true
+}
+
+// release lets another execution probe the plugin, if its circuit is half-open
+func (m *Manager) release(p Plugin) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.circuits[p.id()]; ok {
+		c.probing = false
+	}
+}
+
+// record tracks the outcome of a plugin execution, opening or closing its circuit
+func (m *Manager) record(p Plugin, failed bool) {
+	m.mu.Lock()
+	if m.circuits == nil {
+		m.circuits = map[string]*circuit{}
+	}
+	key := p.id()
+	c, ok := m.circuits[key]
+	if !ok {
+		c = &circuit{state: CircuitClosed}
+		m.circuits[key] = c
+	}
+
+	previous := c.state
+	c.probing = false
+	if failed {
+		c.failures++
+		if c.state == CircuitHalfOpen || c.failures >= m.Breaker.Threshold {
+			c.state = CircuitOpen
+			c.openedAt = time.Now()
+		}
+	} else {
+		c.failures = 0
+		c.state = CircuitClosed
+	}
+	state := c.state
+	m.mu.Unlock()
+
+	if state != previous {
+		m.Bus.Emit(string(EventCircuitChanged), &p, state)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/mudler/go-pluggable"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Circuit breaker", func() {
+	Context("with a failing plugin", func() {
+		var temp, plugin, count string
+		var m *Manager
+		var states []CircuitState
+		var mu sync.Mutex
+
+		exiting := func(exit int) {
+			plugin = writePlugin(temp, "plugin", `echo x >> "`+count+`"
+echo '{ "state": "ok" }'
+exit `+strconv.Itoa(exit))
+		}
+
+		runs := func() int {
+			b, _ := ioutil.ReadFile(count)
+			return len(b) / 2
+		}
+
+		BeforeEach(func() {
+			var err error
+			temp, err = ioutil.TempDir("", "breaker")
+			Expect(err).Should(BeNil())
+			count = filepath.Join(temp, "count")
+			exiting(1)
+
+			states = nil
+			m = NewManager([]EventType{PackageInstalled})
+			m.Plugins = []Plugin{{Name: "test", Executable: plugin}}
+			m.Breaker = &CircuitBreaker{Threshold: 2, Cooldown: 300 * time.Millisecond}
+			m.OnCircuitChange(func(p *Plugin, s CircuitState) {
+				mu.Lock()
+				defer mu.Unlock()
+				states = append(states, s)
+			})
+			m.Register()
+		})
+
+		AfterEach(func() {
+			m.Close()
+			os.RemoveAll(temp)
+		})
+
+		transitions := func() []CircuitState {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]CircuitState{}, states...)
+		}
+
+		It("opens the circuit after consecutive failures", func() {
+			for i := 0; i < 2; i++ {
+				_, err := m.PublishAndCollect(PackageInstalled, "foo")
+				Expect(err).To(HaveOccurred())
+			}
+			Expect(runs()).To(Equal(2))
+			Expect(m.Circuit(m.Plugins[0])).To(Equal(CircuitOpen))
+			Expect(transitions()).To(Equal([]CircuitState{CircuitOpen}))
+
+			results, err := m.PublishAndCollect(PackageInstalled, "foo")
+			Expect(err).To(HaveOccurred())
+			Expect(results[0].Error).To(MatchError(ErrCircuitOpen))
+			Expect(results[0].Response.Errored()).To(BeTrue())
+			Expect(runs()).To(Equal(2))
+		})
+
+		It("doesn't count events the plugin doesn't handle", func() {
+			exiting(0)
+			_, err := m.PublishAndCollect(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+
+			writePlugin(temp, "plugin", `echo '{ "state": "unhandled", "error": "unhandled event package.install" }'`)
+			for i := 0; i < 3; i++ {
+				results, _ := m.PublishAndCollect(PackageInstalled, "foo")
+				Expect(results[0].Response.Unhandled()).To(BeTrue())
+			}
+			Expect(m.Circuit(m.Plugins[0])).To(Equal(CircuitClosed))
+			Expect(transitions()).To(BeEmpty())
+		})
+
+		It("probes the plugin after the cooldown", func() {
+			for i := 0; i < 2; i++ {
+				m.PublishAndCollect(PackageInstalled, "foo")
+			}
+			time.Sleep(400 * time.Millisecond)
+
+			// A failing probe opens the circuit again
+			_, err := m.PublishAndCollect(PackageInstalled, "foo")
+			Expect(err).To(HaveOccurred())
+			Expect(runs()).To(Equal(3))
+			Expect(m.Circuit(m.Plugins[0])).To(Equal(CircuitOpen))
+
+			time.Sleep(400 * time.Millisecond)
+			exiting(0)
+
+			_, err = m.PublishAndCollect(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(runs()).To(Equal(4))
+			Expect(m.Circuit(m.Plugins[0])).To(Equal(CircuitClosed))
+			Expect(transitions()).To(Equal([]CircuitState{
+				CircuitOpen, CircuitHalfOpen, CircuitOpen, CircuitHalfOpen, CircuitClosed,
+			}))
+		})
+	})
+})
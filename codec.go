@@ -0,0 +1,156 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// EncodingJSON is the default encoding, where payloads are carried as JSON in the Data field
+	EncodingJSON = "json"
+	// EncodingMsgpack encodes payloads with MessagePack
+	EncodingMsgpack = "msgpack"
+	// EncodingCBOR encodes payloads with CBOR
+	EncodingCBOR = "cbor"
+)
+
+// Codec encodes and decodes payloads. Struct fields are named after their json tags.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{}
+)
+
+func init() {
+	RegisterCodec(jsonCodec{})
+	RegisterCodec(msgpackCodec{})
+	RegisterCodec(newCBORCodec())
+}
+
+// RegisterCodec makes a codec available for the plugins, replacing any codec with the same name
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Name()] = c
+}
+
+// CodecFor returns the codec with the given name. The empty name is EncodingJSON.
+func CodecFor(name string) (Codec, bool) {
+	if name == "" {
+		name = EncodingJSON
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// Encodings returns the names of the registered codecs, sorted
+func Encodings() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	res := make([]string, 0, len(codecs))
+	for n := range codecs {
+		res = append(res, n)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// isJSONEncoding returns true if the encoding carries the payload as JSON in the Data field
+func isJSONEncoding(encoding string) bool {
+	return encoding == "" || encoding == EncodingJSON
+}
+
+// decodePayload decodes the payload in the given encoding in v
+func decodePayload(encoding, data string, payload []byte, v interface{}) error {
+	if isJSONEncoding(encoding) {
+		return json.Unmarshal([]byte(data), v)
+	}
+	c, ok := CodecFor(encoding)
+	if !ok {
+		return errors.Errorf("unknown encoding %s", encoding)
+	}
+	return c.Unmarshal(payload, v)
+}
+
+// negotiate returns the first encoding of the Manager supported by the plugin,
+// or the empty encoding if there is none
+func (m *Manager) negotiate(supported []string) string {
+	for _, e := range m.Encodings {
+		if _, ok := CodecFor(e); !ok {
+			continue
+		}
+		for _, s := range supported {
+			if s == e {
+				return e
+			}
+		}
+	}
+	return ""
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return EncodingJSON }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return EncodingMsgpack }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	enc := msgpack.NewEncoder(&b)
+	enc.SetCustomStructTag("json")
+	err := enc.Encode(v)
+	return b.Bytes(), err
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+type cborCodec struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func newCBORCodec() cborCodec {
+	enc, _ := cbor.EncOptions{}.EncMode()
+	// Maps decode with string keys, as they do from JSON
+	dec, _ := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}{})}.DecMode()
+	return cborCodec{enc: enc, dec: dec}
+}
+
+func (cborCodec) Name() string                                 { return EncodingCBOR }
+func (c cborCodec) Marshal(v interface{}) ([]byte, error)      { return c.enc.Marshal(v) }
+func (c cborCodec) Unmarshal(data []byte, v interface{}) error { return c.dec.Unmarshal(data, v) }
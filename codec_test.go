@@ -0,0 +1,160 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	. "github.com/mudler/go-pluggable"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type codecPayload struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+	Blob  []byte `json:"blob"`
+}
+
+var _ = Describe("Codecs", func() {
+	payload := codecPayload{Name: "foo", Count: 3, Blob: []byte{0, 1, 2, 255}}
+
+	It("encodes and decodes payloads", func() {
+		for _, enc := range []string{EncodingJSON, EncodingMsgpack, EncodingCBOR} {
+			c, ok := CodecFor(enc)
+			Expect(ok).To(BeTrue())
+			dat, err := c.Marshal(payload)
+			Expect(err).ToNot(HaveOccurred())
+
+			res := codecPayload{}
+			Expect(c.Unmarshal(dat, &res)).To(Succeed())
+			Expect(res).To(Equal(payload), enc)
+
+			fields := map[string]interface{}{}
+			Expect(c.Unmarshal(dat, &fields)).To(Succeed())
+			Expect(fields).To(HaveKey("name"), enc)
+		}
+	})
+
+	It("advertises only the codecs enabled in the factory", func() {
+		describe := func(f *Factory) []string {
+			b := bytes.NewBufferString("")
+			Expect(f.Run(EventDescribe, bytes.NewBufferString(`{"name":"pluggable.describe"}`), b)).To(Succeed())
+			resp := EventResponse{}
+			Expect(json.Unmarshal(b.Bytes(), &resp)).To(Succeed())
+			d := PluginDescription{}
+			Expect(resp.Unmarshal(&d)).To(Succeed())
+			return d.Encodings
+		}
+
+		Expect(describe(NewFactory())).To(BeEmpty())
+		Expect(describe(&Factory{Encodings: []string{EncodingJSON, EncodingCBOR}})).To(Equal([]string{EncodingCBOR}))
+	})
+
+	It("decodes events and encodes responses in the factory", func() {
+		c, _ := CodecFor(EncodingMsgpack)
+		dat, err := c.Marshal(payload)
+		Expect(err).ToNot(HaveOccurred())
+		ev, err := json.Marshal(Event{Name: "foo", Payload: dat, Encoding: EncodingMsgpack})
+		Expect(err).ToNot(HaveOccurred())
+
+		foo := NewEventDef[codecPayload, codecPayload]("foo")
+		factory := NewPluginFactory()
+		foo.Handle(factory, func(e *Event, req codecPayload) (codecPayload, error) {
+			req.Count++
+			return req, nil
+		})
+
+		b := bytes.NewBufferString("")
+		Expect(factory.Run("foo", bytes.NewBuffer(ev), b)).To(Succeed())
+		resp := EventResponse{}
+		Expect(json.Unmarshal(b.Bytes(), &resp)).To(Succeed())
+		Expect(resp.Encoding).To(Equal(EncodingMsgpack))
+		Expect(resp.Data).To(BeEmpty())
+
+		res := codecPayload{}
+		Expect(resp.Unmarshal(&res)).To(Succeed())
+		Expect(res.Count).To(Equal(4))
+		Expect(res.Blob).To(Equal(payload.Blob))
+	})
+
+	Context("with plugins", func() {
+		var temp string
+		var m *Manager
+
+		BeforeEach(func() {
+			var err error
+			temp, err = ioutil.TempDir("", "codec")
+			Expect(err).Should(BeNil())
+
+			// The plugin supports CBOR and responds with the payload it received
+			plugin := writePlugin(temp, "plugin", `if [ "$1" == "pluggable.describe" ]; then
+	echo '{ "data": "{\"name\": \"test\", \"protocolVersion\": 1, \"events\": [\"package.install\"], \"encodings\": [\"cbor\"]}" }'
+else
+	jq -c '{state: .encoding, data: .data, payload: .payload, encoding: .encoding}' <&0
+fi`)
+
+			m = NewManager([]EventType{PackageInstalled})
+			m.Plugins = []Plugin{{Name: "test", Executable: plugin}}
+		})
+
+		AfterEach(func() {
+			m.Close()
+			os.RemoveAll(temp)
+		})
+
+		It("sends JSON by default", func() {
+			m.Handshake = true
+			m.Register()
+			Expect(m.Plugins[0].Encoding).To(BeEmpty())
+
+			results, err := m.PublishAndCollect(PackageInstalled, payload)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results[0].Response.State).To(BeEmpty())
+			res := codecPayload{}
+			Expect(results[0].Response.Unmarshal(&res)).To(Succeed())
+			Expect(res).To(Equal(payload))
+		})
+
+		It("negotiates the codec during the handshake", func() {
+			m.Handshake = true
+			m.Encodings = []string{EncodingMsgpack, EncodingCBOR}
+			m.Register()
+			Expect(m.Plugins[0].Encoding).To(Equal(EncodingCBOR))
+
+			results, err := m.PublishAndCollect(PackageInstalled, payload)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results[0].Response.State).To(Equal(EncodingCBOR))
+			res := codecPayload{}
+			Expect(results[0].Response.Unmarshal(&res)).To(Succeed())
+			Expect(res).To(Equal(payload))
+		})
+
+		It("uses the codec set on the plugin", func() {
+			m.Plugins[0].Encoding = EncodingMsgpack
+			m.Register()
+
+			results, err := m.PublishAndCollect(PackageInstalled, payload)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results[0].Response.State).To(Equal(EncodingMsgpack))
+			res := codecPayload{}
+			Expect(results[0].Response.Unmarshal(&res)).To(Succeed())
+			Expect(res).To(Equal(payload))
+		})
+	})
+})
@@ -0,0 +1,305 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// EventServe is the event passed to plugins started in persistent mode.
+// Plugins receiving it are expected to serve events from stdin until it is closed.
+const EventServe EventType = "pluggable.serve"
+
+// ErrPluginExited is returned for requests in flight when a persistent plugin dies
+var ErrPluginExited = errors.New("persistent plugin exited")
+
+// stopGracePeriod is how long a persistent plugin is given to exit after its stdin is closed
+const stopGracePeriod = 5 * time.Second
+
+// serveRequest is a frame sent to persistent plugins. Frames are newline delimited JSON.
+type serveRequest struct {
+	ID    uint64 `json:"id"`
+	Event Event  `json:"event"`
+}
+
+// serveResponse is a frame sent back by persistent plugins
+type serveResponse struct {
+	ID       uint64        `json:"id"`
+	Response EventResponse `json:"response"`
+}
+
+type daemonResponse struct {
+	resp EventResponse
+	err  error
+}
+
+// daemon keeps a persistent plugin process running and multiplexes requests over its stdio
+type daemon struct {
+	plugin Plugin
+
+	sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	exited  chan struct{}
+	stderr  *tailBuffer
+	nextID  uint64
+	pending map[uint64]chan daemonResponse
+
+	write sync.Mutex
+}
+
+func newDaemon(p Plugin) *daemon {
+	return &daemon{plugin: p, pending: map[uint64]chan daemonResponse{}}
+}
+
+// start spawns the plugin process. It must be called with the daemon locked.
+func (d *daemon) start() error {
+	cmd := d.plugin.command(string(EventServe))
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	d.stderr = &tailBuffer{}
+	cmd.Stderr = d.stderr
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "while starting persistent plugin")
+	}
+
+	d.cmd = cmd
+	d.stdin = stdin
+	d.exited = make(chan struct{})
+	go d.read(cmd, stdout, d.exited)
+	return nil
+}
+
+// read dispatches the responses of the plugin to the pending requests until it exits
+func (d *daemon) read(cmd *exec.Cmd, stdout io.Reader, exited chan struct{}) {
+	r := bufio.NewReader(stdout)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if id, resp, ok := d.decode(line); ok {
+				d.Lock()
+				ch, ok := d.pending[id]
+				delete(d.pending, id)
+				d.Unlock()
+				if ok {
+					ch <- resp
+				}
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	cmd.Wait()
+
+	d.Lock()
+	if d.cmd == cmd {
+		d.cmd = nil
+		d.stdin = nil
+	}
+	d.Unlock()
+	close(exited)
+}
+
+// run sends the event to the plugin, starting it if it isn't running, and waits for its response
+func (d *daemon) run(ctx context.Context, e Event) (EventResponse, error) {
+	r := EventResponse{}
+
+	if d.plugin.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.plugin.Timeout)
+		defer cancel()
+	}
+
+	d.Lock()
+	if d.cmd == nil {
+		if err := d.start(); err != nil {
+			d.Unlock()
+			r.Error = "error while executing plugin: " + err.Error()
+			return r, err
+		}
+	}
+	d.nextID++
+	id := d.nextID
+	ch := make(chan daemonResponse, 1)
+	d.pending[id] = ch
+	stdin, exited, stderr := d.stdin, d.exited, d.stderr
+	d.Unlock()
+
+	dat, err := d.encode(id, e)
+	if err != nil {
+		d.forget(id)
+		return r, errors.Wrap(err, "while marshalling event")
+	}
+
+	// The write blocks if the plugin doesn't read its stdin, so it
+	// happens in the background while waiting for the context
+	written := make(chan error, 1)
+	go func() {
+		d.write.Lock()
+		defer d.write.Unlock()
+		_, err := stdin.Write(append(dat, '\n'))
+		written <- err
+	}()
+
+	exitedErr := func() (EventResponse, error) {
+		d.forget(id)
+		r.Error = "error while executing plugin: " + ErrPluginExited.Error() + ": " + stderr.String()
+		return r, errors.Wrap(ErrPluginExited, stderr.String())
+	}
+	doneErr := func() (EventResponse, error) {
+		d.forget(id)
+		err := ctx.Err()
+		if err == context.DeadlineExceeded {
+			err = ErrPluginTimeout
+			r.State = StateTimeout
+		}
+		r.Error = "error while executing plugin: " + err.Error()
+		return r, errors.Wrap(err, "while executing plugin")
+	}
+
+	select {
+	case err := <-written:
+		if err != nil {
+			d.forget(id)
+			r.Error = "error while executing plugin: " + err.Error()
+			return r, errors.Wrap(err, "while writing to persistent plugin")
+		}
+	case <-exited:
+		return exitedErr()
+	case <-ctx.Done():
+		// The frame might be partially written, or the plugin stuck not reading it:
+		// it is killed, failing the pending writes, and restarted on the next request
+		d.kill()
+		return doneErr()
+	}
+
+	select {
+	case res := <-ch:
+		return res.resp, res.err
+	case <-exited:
+		return exitedErr()
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			// The plugin might be stuck, it is restarted on the next request
+			d.kill()
+		}
+		return doneErr()
+	}
+}
+
+// encode returns the request frame for the event in the plugin protocol
+func (d *daemon) encode(id uint64, e Event) ([]byte, error) {
+	e, err := e.encoded(d.plugin.encoding())
+	if err != nil {
+		return nil, err
+	}
+	if d.plugin.Protocol == ProtocolJSONRPC {
+		return json.Marshal(newRPCRequest(id, e))
+	}
+	return json.Marshal(serveRequest{ID: id, Event: e})
+}
+
+// decode parses a response frame in the plugin protocol. Lines which are not valid frames are ignored.
+func (d *daemon) decode(line []byte) (uint64, daemonResponse, bool) {
+	if d.plugin.Protocol == ProtocolJSONRPC {
+		rr := rpcResponse{}
+		if json.Unmarshal(line, &rr) != nil {
+			return 0, daemonResponse{}, false
+		}
+		id, ok := rr.id()
+		resp, err := rr.eventResponse()
+		return id, daemonResponse{resp: resp, err: err}, ok
+	}
+
+	resp := serveResponse{}
+	if json.Unmarshal(line, &resp) != nil {
+		return 0, daemonResponse{}, false
+	}
+	return resp.ID, daemonResponse{resp: resp.Response}, true
+}
+
+func (d *daemon) forget(id uint64) {
+	d.Lock()
+	delete(d.pending, id)
+	d.Unlock()
+}
+
+func (d *daemon) kill() {
+	d.Lock()
+	cmd := d.cmd
+	d.Unlock()
+	if cmd != nil {
+		killProcessGroup(cmd)
+	}
+}
+
+// stop closes the plugin stdin, and kills it if it doesn't exit in time
+func (d *daemon) stop() {
+	d.Lock()
+	cmd, stdin, exited := d.cmd, d.stdin, d.exited
+	d.Unlock()
+	if cmd == nil {
+		return
+	}
+
+	stdin.Close()
+	select {
+	case <-exited:
+	case <-time.After(stopGracePeriod):
+		killProcessGroup(cmd)
+		<-exited
+	}
+}
+
+// tailBuffer retains the last bytes written to it
+type tailBuffer struct {
+	sync.Mutex
+	buf []byte
+}
+
+const tailBufferSize = 1 << 12
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > tailBufferSize {
+		t.buf = t.buf[len(t.buf)-tailBufferSize:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.Lock()
+	defer t.Unlock()
+	return string(t.buf)
+}
@@ -0,0 +1,112 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// EventDescribe is the event sent to plugins during the handshake.
+// Plugins supporting it reply with a PluginDescription encoded in the response data.
+const EventDescribe EventType = "pluggable.describe"
+
+// ProtocolVersion is the version of the plugin protocol implemented by this package
+const ProtocolVersion = 1
+
+// ErrNoDescription is returned by plugins which don't support the handshake
+var ErrNoDescription = errors.New("plugin doesn't support the handshake")
+
+// PluginDescription is the answer of a plugin to EventDescribe
+type PluginDescription struct {
+	Name            string      `json:"name"`
+	Version         string      `json:"version"`
+	ProtocolVersion int         `json:"protocolVersion"`
+	Events          []EventType `json:"events"`
+	// Encodings are the codecs supported by the plugin, besides JSON
+	Encodings []string `json:"encodings,omitempty"`
+}
+
+// Describe runs the handshake with the plugin, and returns its description.
+// It returns ErrNoDescription if the plugin doesn't answer with a valid description.
+func (m *Manager) Describe(p Plugin) (*PluginDescription, error) {
+	e, err := NewEvent(EventDescribe, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := m.run(context.Background(), p, *e)
+	if err != nil {
+		return nil, errors.Wrap(err, "while describing plugin "+p.Name)
+	}
+	if resp.Errored() {
+		return nil, errors.Wrap(ErrNoDescription, resp.Error)
+	}
+
+	d := &PluginDescription{}
+	if err := json.Unmarshal([]byte(resp.Data), d); err != nil || d.ProtocolVersion == 0 {
+		return nil, ErrNoDescription
+	}
+	return d, nil
+}
+
+// describe runs the handshake with all the plugins, restricting
+// their events to the ones they declare
+func (m *Manager) describe() {
+	var pending []Plugin
+	m.mu.Lock()
+	for _, p := range m.Plugins {
+		if p.Description == nil {
+			pending = append(pending, p)
+		}
+	}
+	m.mu.Unlock()
+
+	descriptions := make([]*PluginDescription, len(pending))
+	var wg sync.WaitGroup
+	for i, p := range pending {
+		wg.Add(1)
+		go func(i int, p Plugin) {
+			defer wg.Done()
+			descriptions[i], _ = m.Describe(p)
+		}(i, p)
+	}
+	wg.Wait()
+
+	// Plugins might have been added or removed meanwhile, so they are matched by id
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, p := range pending {
+		if descriptions[i] == nil {
+			continue
+		}
+		for j := range m.Plugins {
+			if m.Plugins[j].id() == p.id() && m.Plugins[j].Description == nil {
+				m.described(&m.Plugins[j], descriptions[i])
+			}
+		}
+	}
+}
+
+// described applies the description to the plugin
+func (m *Manager) described(p *Plugin, d *PluginDescription) {
+	p.Description = d
+	p.Events = d.Events
+	if p.Encoding == "" {
+		p.Encoding = m.negotiate(d.Encodings)
+	}
+}
@@ -14,8 +14,12 @@ limitations under the License.
 package pluggable
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+
+	"github.com/pkg/errors"
 )
 
 // EventType describes an event type
@@ -27,9 +31,31 @@ type EventType string
 type Event struct {
 	Name EventType `json:"name"`
 	Data string    `json:"data"`
-	File string    `json:"file"` // If Data >> 10K write content to file instead
+	File string    `json:"file"` // Path of the payload, with TransportFile
+
+	// Stream tells the payload is streamed, with TransportStdin or TransportFD
+	Stream Transport `json:"stream,omitempty"`
+	// Size is the size in bytes of the streamed payload
+	Size int `json:"size,omitempty"`
+
+	// Payload carries the payload when it is not encoded in JSON, see Encoding
+	Payload []byte `json:"payload,omitempty"`
+	// Encoding is the codec of Payload. When empty, the payload is JSON in Data.
+	Encoding string `json:"encoding,omitempty"`
+
+	Metadata *EventMetadata `json:"metadata,omitempty"`
+
+	ctx     context.Context
+	results *collector
+	// obj is the published object, encoded for each plugin with its codec,
+	// as long as the payload is still objPayload
+	obj        interface{}
+	objPayload []byte
 }
 
+// StateTimeout is the state of responses of plugins which didn't complete in time
+const StateTimeout = "timeout"
+
 // EventResponse describes the event response structure
 // It represent the JSON response from plugins
 type EventResponse struct {
@@ -37,6 +63,22 @@ type EventResponse struct {
 	Data  string `json:"data"`
 	Error string `json:"error"`
 	Logs  string `json:"log"`
+	// Entries are the structured logs of the plugin, also part of Logs
+	Entries []LogEntry `json:"entries,omitempty"`
+
+	// Payload carries the data when it is not encoded in JSON, see Encoding
+	Payload []byte `json:"payload,omitempty"`
+	// Encoding is the codec of Payload. When empty, the data is JSON in Data.
+	Encoding string `json:"encoding,omitempty"`
+
+	// Metadata is the metadata of the event the response is for
+	Metadata *EventMetadata `json:"metadata,omitempty"`
+
+	// Attempts is the number of times the plugin was run to get the response
+	Attempts int `json:"-"`
+	// Event is the name of the event the response is for, useful
+	// to Response listeners bound to event patterns
+	Event EventType `json:"-"`
 }
 
 // JSON returns the stringified JSON of the Event
@@ -51,13 +93,79 @@ func (e Event) Copy() *Event {
 	return copy
 }
 
+// Context returns the event context, which is context.Background if not set
+func (e Event) Context() context.Context {
+	if e.ctx != nil {
+		return e.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a copy of Event bound to the given context
+func (e Event) WithContext(ctx context.Context) *Event {
+	copy := e.Copy()
+	copy.ctx = ctx
+	return copy
+}
+
 func (e Event) ResponseEventName(s string) EventType {
 	return EventType(fmt.Sprintf("%s-%s", e.Name, s))
 }
 
-// Unmarshal decodes the json payload in the given parameteer
+// Unmarshal decodes the payload in the given parameteer, with the codec of the response
 func (r EventResponse) Unmarshal(i interface{}) error {
-	return json.Unmarshal([]byte(r.Data), i)
+	return decodePayload(r.Encoding, r.Data, r.Payload, i)
+}
+
+// HasData returns true if the response carries data, in any encoding
+func (r EventResponse) HasData() bool {
+	return r.Data != "" || len(r.Payload) > 0
+}
+
+// Unmarshal decodes the payload in the given parameter, with the codec of the event
+func (e Event) Unmarshal(i interface{}) error {
+	return decodePayload(e.Encoding, e.Data, e.Payload, i)
+}
+
+// Respond returns a response carrying v as data, encoded with the codec of the event
+func (e Event) Respond(v interface{}) (EventResponse, error) {
+	enc, err := e.encode(e.Encoding, v)
+	return EventResponse{Data: enc.Data, Payload: enc.Payload, Encoding: enc.Encoding}, err
+}
+
+// encoded returns a copy of the event with the payload encoded with the given codec
+func (e Event) encoded(encoding string) (Event, error) {
+	if isJSONEncoding(encoding) && isJSONEncoding(e.Encoding) || encoding == e.Encoding {
+		return e, nil
+	}
+
+	v := e.obj
+	if v == nil || !bytes.Equal(e.payload(), e.objPayload) {
+		if err := e.Unmarshal(&v); err != nil {
+			return e, errors.Wrap(err, "while decoding payload")
+		}
+	}
+	return e.encode(encoding, v)
+}
+
+// encode returns a copy of the event with v as payload, encoded with the given codec
+func (e Event) encode(encoding string, v interface{}) (Event, error) {
+	c, ok := CodecFor(encoding)
+	if !ok {
+		return e, errors.Errorf("unknown encoding %s", encoding)
+	}
+	dat, err := c.Marshal(v)
+	if err != nil {
+		return e, errors.Wrap(err, "while encoding payload")
+	}
+
+	e.obj, e.objPayload = v, dat
+	if isJSONEncoding(encoding) {
+		e.Data, e.Payload, e.Encoding = string(dat), nil, ""
+	} else {
+		e.Data, e.Payload, e.Encoding = "", dat, encoding
+	}
+	return e, nil
 }
 
 // Errored returns true if the response contains an error
@@ -65,9 +173,15 @@ func (r EventResponse) Errored() bool {
 	return len(r.Error) != 0
 }
 
+// Unhandled returns true if the plugin responded that it doesn't handle the event
+func (r EventResponse) Unhandled() bool {
+	return r.State == StateUnhandled
+}
+
 // NewEvent returns a new event which can be used for publishing
 // the obj gets automatically serialized in json.
+// The event gets new metadata, see EventMetadata.
 func NewEvent(name EventType, obj interface{}) (*Event, error) {
 	dat, err := json.Marshal(obj)
-	return &Event{Name: name, Data: string(dat)}, err
+	return &Event{Name: name, Data: string(dat), Metadata: NewEventMetadata(), obj: obj, objPayload: dat}, err
 }
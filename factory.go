@@ -14,11 +14,22 @@ limitations under the License.
 package pluggable
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+)
+
+const (
+	// StatePanic is the state of responses of handlers which panicked
+	StatePanic = "panic"
+	// StateUnhandled is the state of responses to events without handler
+	StateUnhandled = "unhandled"
 )
 
 type FactoryPlugin struct {
@@ -34,21 +45,69 @@ func NewPluginFactory(p ...FactoryPlugin) PluginFactory {
 	return f
 }
 
+// NewFactory returns a Factory with the given handlers, see NewPluginFactory
+func NewFactory(p ...FactoryPlugin) *Factory {
+	return &Factory{PluginFactory: NewPluginFactory(p...)}
+}
+
 // PluginHandler represent a generic plugin which
 // talks go-pluggable API
 // It receives an event, and is always expected to give a response
 type PluginHandler func(*Event) EventResponse
 
+// Middleware wraps a PluginHandler, to run code before or after it
+type Middleware func(PluginHandler) PluginHandler
+
 // PluginFactory is a collection of handlers for a given event type.
 // a plugin has to respond to multiple events and it always needs to return an
 // Event response as result
 type PluginFactory map[EventType]PluginHandler
 
+// Factory is a PluginFactory with middleware wrapping its handlers,
+// and the description it answers the handshake with
+type Factory struct {
+	PluginFactory
+
+	// Name and Version of the plugin, Name defaults to the executable name
+	Name, Version string
+	// Encodings are the codecs advertised to the Manager besides JSON. Handlers
+	// get the payloads encoded with them, and have to decode them with Event.Unmarshal.
+	Encodings []string
+
+	// middleware wraps all the handlers, and events middleware the handlers of each event
+	middleware []Middleware
+	events     map[EventType][]Middleware
+}
+
 // Run runs the PluginHandler given a event type and a payload
 //
 // The result is written to the writer provided
-// as argument.
+// as argument. Payloads are read with any Transport.
+// If the event is EventServe, Run serves events until
+// the reader is closed, see Serve.
 func (p PluginFactory) Run(name EventType, r io.Reader, w io.Writer) error {
+	return p.factory().Run(name, r, w)
+}
+
+// Serve reads newline delimited events from the reader and writes the responses
+// to the writer, until the reader is closed. This is the protocol used
+// by the Manager to talk with Persistent plugins. JSON-RPC requests are
+// served as well.
+func (p PluginFactory) Serve(r io.Reader, w io.Writer) error {
+	return p.factory().Serve(r, w)
+}
+
+// factory returns a Factory without middleware serving the handlers
+func (p PluginFactory) factory() *Factory {
+	return &Factory{PluginFactory: p}
+}
+
+// Run is PluginFactory.Run, with the handlers wrapped in the middleware
+func (p *Factory) Run(name EventType, r io.Reader, w io.Writer) error {
+	if name == EventServe {
+		return p.Serve(r, w)
+	}
+
 	ev := &Event{}
 
 	b, err := io.ReadAll(r)
@@ -56,62 +115,204 @@ func (p PluginFactory) Run(name EventType, r io.Reader, w io.Writer) error {
 		return err
 	}
 
-	if err := json.Unmarshal(b, ev); err != nil {
+	if isJSONRPC(b) {
+		dat, err := p.handleRPC(b)
+		if err != nil || dat == nil {
+			return err
+		}
+		_, err = w.Write(dat)
 		return err
 	}
 
-	if ev.File != "" {
-		c, err := ioutil.ReadFile(ev.File)
+	if err := readEvent(b, ev); err != nil {
+		return err
+	}
+
+	dat, err := json.Marshal(p.handle(name, ev))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(dat)
+	return err
+}
+
+// Serve is PluginFactory.Serve, with the handlers wrapped in the middleware
+func (p *Factory) Serve(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if isJSONRPC(line) {
+			dat, err := p.handleRPC(line)
+			if err != nil {
+				return err
+			}
+			if dat != nil {
+				if _, err := w.Write(append(dat, '\n')); err != nil {
+					return err
+				}
+			}
+		} else if len(bytes.TrimSpace(line)) > 0 {
+			req := serveRequest{}
+			if err := json.Unmarshal(line, &req); err != nil {
+				return err
+			}
+
+			resp := p.handle(req.Event.Name, &req.Event)
+			dat, err := json.Marshal(serveResponse{ID: req.ID, Response: resp})
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(append(dat, '\n')); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
+	}
+}
 
-		ev.Data = string(c)
+// handleRPC runs the handler for a JSON-RPC request and returns the encoded response.
+// Notifications, which have no id, get no response.
+func (p *Factory) handleRPC(b []byte) ([]byte, error) {
+	req := rpcRequest{}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return json.Marshal(newRPCError(nil, RPCParseError, err.Error()))
+	}
+	if req.Method == "" {
+		return json.Marshal(newRPCError(req.ID, RPCInvalidRequest, "missing method"))
 	}
 
-	old := os.Stdout
-	oldErr := os.Stderr
+	name := EventType(req.Method)
+	if _, ok := p.handler(name); !ok {
+		if len(req.ID) == 0 {
+			return nil, nil
+		}
+		return json.Marshal(newRPCError(req.ID, RPCMethodNotFound, "unhandled event "+req.Method))
+	}
 
-	re, ww, err := os.Pipe()
-	if err != nil {
-		return err
+	resp := p.handle(name, req.event())
+	if len(req.ID) == 0 {
+		return nil, nil
 	}
+	return json.Marshal(newRPCResponse(req.ID, resp))
+}
 
-	os.Stdout = ww
-	os.Stderr = ww
-	outC := make(chan string)
+// handle runs the handler associated to the event, returning what it logged
+// with the event Logger in the response. Events without handler get a
+// response with StateUnhandled, and panics a response with StatePanic.
+func (p *Factory) handle(name EventType, ev *Event) EventResponse {
+	l := &Logger{}
+	var resp EventResponse
+	if h, ok := p.handler(name); ok {
+		resp = recovered(h, ev.withLogger(l))
+	} else {
+		resp = EventResponse{State: StateUnhandled, Error: "unhandled event " + string(name)}
+	}
 
-	// copy the output in a separate goroutine so printing can't block indefinitely
-	go func() {
-		var buf bytes.Buffer
-		io.Copy(&buf, re)
-		outC <- buf.String()
-	}()
+	if entries := l.Entries(); len(entries) > 0 {
+		resp.Entries = append(resp.Entries, entries...)
+		resp.Logs += l.String()
+	}
+	if resp.Metadata == nil {
+		resp.Metadata = ev.Metadata
+	}
+	return resp
+}
 
-	resp := EventResponse{}
-	for e, r := range p {
-		if name == e {
-			resp = r(ev)
+// recovered runs the handler, turning panics into a response with StatePanic
+// and the stack trace in the logs
+func recovered(h PluginHandler, e *Event) (resp EventResponse) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.Logger().Errorf("panic: %v\n%s", r, debug.Stack())
+			resp = EventResponse{State: StatePanic, Error: fmt.Sprintf("panic: %v", r)}
 		}
+	}()
+	return h(e)
+}
+
+// handler returns the handler for the event, wrapped in its middleware.
+// EventDescribe is answered from the registered handlers, unless a handler
+// is registered for it.
+func (p *Factory) handler(name EventType) (PluginHandler, bool) {
+	if h, ok := p.PluginFactory[name]; ok {
+		return p.wrap(name, h), true
 	}
+	if name == EventDescribe {
+		return p.describe, true
+	}
+	return nil, false
+}
 
-	// restoring the real stdout
-	ww.Close()
-	os.Stdout = old
-	os.Stderr = oldErr
-	out := <-outC
-	resp.Logs = out
+// describe answers the handshake with the events handled by the factory
+func (p *Factory) describe(*Event) EventResponse {
+	d := PluginDescription{
+		Name:            p.Name,
+		Version:         p.Version,
+		ProtocolVersion: ProtocolVersion,
+	}
+	if d.Name == "" {
+		d.Name = filepath.Base(os.Args[0])
+	}
+	for e := range p.PluginFactory {
+		d.Events = append(d.Events, e)
+	}
+	sort.Slice(d.Events, func(i, j int) bool { return d.Events[i] < d.Events[j] })
+	for _, e := range p.Encodings {
+		if !isJSONEncoding(e) {
+			d.Encodings = append(d.Encodings, e)
+		}
+	}
 
-	dat, err := json.Marshal(resp)
+	dat, err := json.Marshal(d)
 	if err != nil {
-		return err
+		return EventResponse{Error: err.Error()}
 	}
-
-	_, err = w.Write(dat)
-	return err
+	return EventResponse{Data: string(dat)}
 }
 
 // Add associates an handler to an event type
 func (p PluginFactory) Add(ev EventType, ph PluginHandler) {
 	p[ev] = ph
 }
+
+// Add associates an handler to an event type
+func (p *Factory) Add(ev EventType, ph PluginHandler) {
+	if p.PluginFactory == nil {
+		p.PluginFactory = make(PluginFactory)
+	}
+	p.PluginFactory.Add(ev, ph)
+}
+
+// Use adds middleware wrapping the handlers of all the events.
+// Middleware added first runs first.
+func (p *Factory) Use(mw ...Middleware) *Factory {
+	p.middleware = append(p.middleware, mw...)
+	return p
+}
+
+// UseFor adds middleware wrapping the handler of the event, inside the
+// middleware of all the events. Middleware added first runs first.
+func (p *Factory) UseFor(ev EventType, mw ...Middleware) *Factory {
+	if p.events == nil {
+		p.events = map[EventType][]Middleware{}
+	}
+	p.events[ev] = append(p.events[ev], mw...)
+	return p
+}
+
+// wrap wraps the handler of the event in its middleware
+func (p *Factory) wrap(ev EventType, h PluginHandler) PluginHandler {
+	for i := len(p.events[ev]) - 1; i >= 0; i-- {
+		h = p.events[ev][i](h)
+	}
+	for i := len(p.middleware) - 1; i >= 0; i-- {
+		h = p.middleware[i](h)
+	}
+	return h
+}
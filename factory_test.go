@@ -17,7 +17,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 
 	. "github.com/mudler/go-pluggable"
 
@@ -39,11 +42,11 @@ var _ = Describe("PluginFactory", func() {
 
 			payloadDat, err := json.Marshal(payload)
 			Expect(err).ToNot(HaveOccurred())
-			factory.Add("foo", func(e *Event) EventResponse {
+			factory.Add("foo", CaptureOutput(func(e *Event) EventResponse {
 				fmt.Println("logtest")
 				os.Stderr.WriteString("errmessage")
 				return EventResponse{State: "foo", Data: fmt.Sprint(e.Data == "bar")}
-			})
+			}))
 			err = factory.Run("foo", bytes.NewBuffer(payloadDat), b)
 			Expect(err).ToNot(HaveOccurred())
 
@@ -54,5 +57,153 @@ var _ = Describe("PluginFactory", func() {
 			Expect(resp.Data).To(Equal("true"))
 			Expect(resp.Logs).To(Equal("logtest\nerrmessage"))
 		})
+
+		It("is a map of handlers", func() {
+			var f PluginFactory = make(PluginFactory)
+			f["foo"] = func(e *Event) EventResponse { return EventResponse{State: "foo"} }
+			Expect(f).To(HaveKey(EventType("foo")))
+
+			payloadDat, err := json.Marshal(&Event{Name: "foo"})
+			Expect(err).ToNot(HaveOccurred())
+			b := bytes.NewBufferString("")
+			Expect(f.Run("foo", bytes.NewBuffer(payloadDat), b)).To(Succeed())
+
+			resp := &EventResponse{}
+			Expect(json.Unmarshal(b.Bytes(), resp)).To(Succeed())
+			Expect(resp.State).To(Equal("foo"))
+		})
+
+		It("returns the logs of the event logger", func() {
+			factory.Add("foo", func(e *Event) EventResponse {
+				e.Logger().Debug("starting")
+				e.Logger().Warnf("%d retries", 3)
+				return EventResponse{State: "foo", Logs: "own\n"}
+			})
+
+			payloadDat, err := json.Marshal(&Event{Name: "foo"})
+			Expect(err).ToNot(HaveOccurred())
+			b := bytes.NewBufferString("")
+			Expect(factory.Run("foo", bytes.NewBuffer(payloadDat), b)).To(Succeed())
+
+			resp := &EventResponse{}
+			Expect(json.Unmarshal(b.Bytes(), resp)).To(Succeed())
+			Expect(resp.Logs).To(Equal("own\ndebug: starting\nwarn: 3 retries\n"))
+			Expect(len(resp.Entries)).To(Equal(2))
+			Expect(resp.Entries[0].Level).To(Equal(LogDebug))
+			Expect(resp.Entries[1].Level).To(Equal(LogWarn))
+			Expect(resp.Entries[1].Message).To(Equal("3 retries"))
+		})
+
+		It("recovers from panics", func() {
+			stdout := os.Stdout
+			factory.Add("foo", CaptureOutput(func(e *Event) EventResponse {
+				fmt.Println("before")
+				panic("boom")
+			}))
+
+			payloadDat, err := json.Marshal(&Event{Name: "foo"})
+			Expect(err).ToNot(HaveOccurred())
+			b := bytes.NewBufferString("")
+			Expect(factory.Run("foo", bytes.NewBuffer(payloadDat), b)).To(Succeed())
+			Expect(os.Stdout).To(Equal(stdout))
+
+			resp := &EventResponse{}
+			Expect(json.Unmarshal(b.Bytes(), resp)).To(Succeed())
+			Expect(resp.State).To(Equal(StatePanic))
+			Expect(resp.Error).To(Equal("panic: boom"))
+			Expect(resp.Logs).To(ContainSubstring("info: before"))
+			Expect(resp.Logs).To(ContainSubstring("factory_test.go"))
+		})
+
+		It("responds with an error to unhandled events", func() {
+			payloadDat, err := json.Marshal(&Event{Name: "bar"})
+			Expect(err).ToNot(HaveOccurred())
+			b := bytes.NewBufferString("")
+			Expect(factory.Run("bar", bytes.NewBuffer(payloadDat), b)).To(Succeed())
+
+			resp := &EventResponse{}
+			Expect(json.Unmarshal(b.Bytes(), resp)).To(Succeed())
+			Expect(resp.State).To(Equal(StateUnhandled))
+			Expect(resp.Error).To(Equal("unhandled event bar"))
+		})
+
+		It("serves events from a stream", func() {
+			factory.Add("foo", func(e *Event) EventResponse {
+				fmt.Fprintln(e.Logger(), "logtest")
+				return EventResponse{State: "foo", Data: e.Data}
+			})
+
+			in := bytes.NewBufferString(`{"id":1,"event":{"name":"foo","data":"bar"}}` + "\n" +
+				`{"id":2,"event":{"name":"foo","data":"baz"}}` + "\n")
+			out := bytes.NewBufferString("")
+			err := factory.Run(EventServe, in, out)
+			Expect(err).ToNot(HaveOccurred())
+
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			Expect(len(lines)).To(Equal(2))
+
+			resp := struct {
+				ID       int           `json:"id"`
+				Response EventResponse `json:"response"`
+			}{}
+			Expect(json.Unmarshal([]byte(lines[1]), &resp)).To(Succeed())
+			Expect(resp.ID).To(Equal(2))
+			Expect(resp.Response.Data).To(Equal("baz"))
+			Expect(resp.Response.Logs).To(Equal("info: logtest\n"))
+		})
+
+		It("talks JSON-RPC", func() {
+			factory.Add("foo", func(e *Event) EventResponse {
+				return EventResponse{State: "done", Data: e.Data}
+			})
+			factory.Add("fail", func(e *Event) EventResponse {
+				return EventResponse{Error: "failed"}
+			})
+
+			out := bytes.NewBufferString("")
+			err := factory.Run("foo", bytes.NewBufferString(`{"jsonrpc":"2.0","id":7,"method":"foo","params":{"foo":"bar"}}`), out)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out.String()).To(MatchJSON(`{"jsonrpc":"2.0","id":7,"result":{"state":"done","data":"{\"foo\":\"bar\"}"}}`))
+
+			out.Reset()
+			err = factory.Run("fail", bytes.NewBufferString(`{"jsonrpc":"2.0","id":8,"method":"fail"}`), out)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out.String()).To(MatchJSON(`{"jsonrpc":"2.0","id":8,"error":{"code":-32000,"message":"failed","data":{"data":""}}}`))
+
+			out.Reset()
+			err = factory.Run("bar", bytes.NewBufferString(`{"jsonrpc":"2.0","id":9,"method":"bar"}`), out)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out.String()).To(MatchJSON(`{"jsonrpc":"2.0","id":9,"error":{"code":-32601,"message":"unhandled event bar"}}`))
+		})
+
+		It("describes the handled events", func() {
+			factory.Add("foo", func(e *Event) EventResponse { return EventResponse{} })
+			factory.Add("bar", func(e *Event) EventResponse { return EventResponse{} })
+
+			describe := func(f interface {
+				Run(EventType, io.Reader, io.Writer) error
+			}) *PluginDescription {
+				out := bytes.NewBufferString("")
+				err := f.Run(EventDescribe, bytes.NewBufferString(`{"name":"pluggable.describe"}`), out)
+				Expect(err).ToNot(HaveOccurred())
+
+				resp := &EventResponse{}
+				Expect(json.Unmarshal(out.Bytes(), resp)).To(Succeed())
+				d := &PluginDescription{}
+				Expect(resp.Unmarshal(d)).To(Succeed())
+				return d
+			}
+
+			d := describe(factory)
+			Expect(d.ProtocolVersion).To(Equal(ProtocolVersion))
+			Expect(d.Events).To(Equal([]EventType{"bar", "foo"}))
+			Expect(d.Name).To(Equal(filepath.Base(os.Args[0])))
+			Expect(d.Version).To(BeEmpty())
+
+			d = describe(&Factory{PluginFactory: factory, Name: "foobar", Version: "1.2.3"})
+			Expect(d.Name).To(Equal("foobar"))
+			Expect(d.Version).To(Equal("1.2.3"))
+			Expect(d.Events).To(Equal([]EventType{"bar", "foo"}))
+		})
 	})
 })
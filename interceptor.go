@@ -0,0 +1,58 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// ErrSkipPlugin is returned by interceptors to skip a plugin: it is not run,
+// and no response is delivered for it
+var ErrSkipPlugin = errors.New("plugin skipped")
+
+// Invoker runs an event on a plugin
+type Invoker func(ctx context.Context, p Plugin, e Event) (EventResponse, error)
+
+// Interceptor is called in place of each plugin invocation, with the next Invoker
+// of the chain which eventually runs the plugin. It can inspect or change the
+// event passed to next, skip the plugin returning ErrSkipPlugin, return a
+// response without calling next, or change the response returned by next.
+type Interceptor func(ctx context.Context, p Plugin, e Event, next Invoker) (EventResponse, error)
+
+// intercept runs the event on the plugin through the Manager interceptors.
+// Interceptors added first run first.
+func (m *Manager) intercept(ctx context.Context, p Plugin, e Event) (EventResponse, error) {
+	m.mu.Lock()
+	interceptors := m.Interceptors
+	m.mu.Unlock()
+
+	invoke := Invoker(m.guard)
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		ic, next := interceptors[i], invoke
+		invoke = func(ctx context.Context, p Plugin, e Event) (EventResponse, error) {
+			return ic(ctx, p, e, next)
+		}
+	}
+	return invoke(ctx, p, e)
+}
+
+// Intercept adds interceptors around the plugin invocations, see Interceptor
+func (m *Manager) Intercept(i ...Interceptor) *Manager {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Interceptors = append(m.Interceptors, i...)
+	return m
+}
@@ -0,0 +1,158 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/mudler/go-pluggable"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Interceptors", func() {
+	var temp string
+	var m *Manager
+
+	runs := func() int {
+		b, _ := ioutil.ReadFile(filepath.Join(temp, "runs"))
+		return len(b)
+	}
+
+	BeforeEach(func() {
+		var err error
+		temp, err = ioutil.TempDir("", "interceptor")
+		Expect(err).Should(BeNil())
+
+		// The plugins respond with the payload they received, recording each run
+		script := `echo -n x >> "` + filepath.Join(temp, "runs") + `"
+jq -c '{state: "ok", data: .data}' <&0`
+		m = NewManager([]EventType{PackageInstalled})
+		for _, n := range []string{"a", "b"} {
+			m.Plugins = append(m.Plugins, Plugin{Name: n, Executable: writePlugin(temp, n, script)})
+		}
+	})
+
+	AfterEach(func() {
+		m.Close()
+		os.RemoveAll(temp)
+	})
+
+	It("changes the event passed to the plugins and their responses", func() {
+		m.Intercept(func(ctx context.Context, p Plugin, e Event, next Invoker) (EventResponse, error) {
+			if p.Name == "a" {
+				e.Data = `"redacted"`
+			}
+			resp, err := next(ctx, p, e)
+			resp.State += "-" + p.Name
+			return resp, err
+		})
+		m.Register()
+
+		results, err := m.PublishAndCollect(PackageInstalled, "secret")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(results[0].Response.Data).To(Equal(`"redacted"`))
+		Expect(results[0].Response.State).To(Equal("ok-a"))
+		Expect(results[1].Response.Data).To(Equal(`"secret"`))
+		Expect(results[1].Response.State).To(Equal("ok-b"))
+	})
+
+	It("skips plugins", func() {
+		var mu sync.Mutex
+		var delivered []string
+		m.Response(PackageInstalled, func(p *Plugin, r *EventResponse) {
+			mu.Lock()
+			defer mu.Unlock()
+			delivered = append(delivered, p.Name)
+		})
+		m.Intercept(func(ctx context.Context, p Plugin, e Event, next Invoker) (EventResponse, error) {
+			if p.Name == "b" {
+				return EventResponse{}, ErrSkipPlugin
+			}
+			return next(ctx, p, e)
+		})
+		m.Register()
+
+		results, err := m.PublishAndCollect(PackageInstalled, "foo")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(len(results)).To(Equal(1))
+		Expect(results[0].Plugin.Name).To(Equal("a"))
+		Expect(delivered).To(Equal([]string{"a"}))
+		Expect(runs()).To(Equal(1))
+	})
+
+	It("short-circuits plugins with a response", func() {
+		m.Plugins = m.Plugins[:1]
+		var mu sync.Mutex
+		cache := map[string]EventResponse{}
+		var order []string
+		m.Intercept(func(ctx context.Context, p Plugin, e Event, next Invoker) (EventResponse, error) {
+			mu.Lock()
+			order = append(order, "first")
+			r, ok := cache[p.Name+e.Data]
+			mu.Unlock()
+			if ok {
+				r.State = "cached"
+				return r, nil
+			}
+			resp, err := next(ctx, p, e)
+			if err == nil {
+				mu.Lock()
+				cache[p.Name+e.Data] = resp
+				mu.Unlock()
+			}
+			return resp, err
+		}, func(ctx context.Context, p Plugin, e Event, next Invoker) (EventResponse, error) {
+			mu.Lock()
+			order = append(order, "second")
+			mu.Unlock()
+			return next(ctx, p, e)
+		})
+		m.Register()
+
+		_, err := m.PublishAndCollect(PackageInstalled, "foo")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(runs()).To(Equal(1))
+		Expect(order).To(Equal([]string{"first", "second"}))
+
+		results, err := m.PublishAndCollect(PackageInstalled, "foo")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(runs()).To(Equal(1))
+		Expect(order).To(Equal([]string{"first", "second", "first"}))
+		Expect(results[0].Response.State).To(Equal("cached"))
+		Expect(results[0].Response.Data).To(Equal(`"foo"`))
+	})
+
+	It("passes changed payloads to plugins with other codecs", func() {
+		m.Plugins[0].Encoding = EncodingMsgpack
+		m.Plugins = m.Plugins[:1]
+		m.Plugins[0].Executable = writePlugin(temp, "a-codec", "jq -c '{payload: .payload, encoding: .encoding}' <&0")
+		m.Intercept(func(ctx context.Context, p Plugin, e Event, next Invoker) (EventResponse, error) {
+			e.Data = `"redacted"`
+			return next(ctx, p, e)
+		})
+		m.Register()
+
+		results, err := m.PublishAndCollect(PackageInstalled, "secret")
+		Expect(err).ToNot(HaveOccurred())
+		var res string
+		Expect(results[0].Response.Unmarshal(&res)).To(Succeed())
+		Expect(res).To(Equal("redacted"))
+	})
+})
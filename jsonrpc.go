@@ -0,0 +1,196 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Protocol is the wire format used to exchange events with a plugin
+type Protocol string
+
+const (
+	// ProtocolDefault exchanges the Event and EventResponse JSON structures
+	ProtocolDefault Protocol = ""
+	// ProtocolJSONRPC exchanges JSON-RPC 2.0 requests and responses.
+	// The event name is the method and the event payload the params.
+	// Payloads which are not JSON objects are wrapped in a one element array,
+	// the event metadata is sent as the metadata member of the request.
+	ProtocolJSONRPC Protocol = "jsonrpc"
+)
+
+const jsonRPCVersion = "2.0"
+
+// JSON-RPC 2.0 error codes
+const (
+	RPCParseError     = -32700
+	RPCInvalidRequest = -32600
+	RPCMethodNotFound = -32601
+	RPCInvalidParams  = -32602
+	RPCInternalError  = -32603
+	// RPCPluginError is used for EventResponses which carry an error
+	RPCPluginError = -32000
+)
+
+// RPCError is a JSON-RPC 2.0 error object. It is returned as error by plugins
+// talking JSON-RPC which reply with an error.
+type RPCError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("jsonrpc error %d: %s", e.Code, e.Message)
+}
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	// Metadata is an extension member carrying the event metadata
+	Metadata *EventMetadata `json:"metadata,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+// rpcResult is the result object built from an EventResponse
+type rpcResult struct {
+	State string `json:"state,omitempty"`
+	Data  string `json:"data"`
+	Logs  string `json:"log,omitempty"`
+}
+
+// isJSONRPC returns true if the message is a JSON-RPC 2.0 request or response
+func isJSONRPC(b []byte) bool {
+	v := struct {
+		JSONRPC string `json:"jsonrpc"`
+	}{}
+	return json.Unmarshal(b, &v) == nil && v.JSONRPC == jsonRPCVersion
+}
+
+// newRPCRequest encodes the event as a JSON-RPC request
+func newRPCRequest(id uint64, e Event) rpcRequest {
+	return rpcRequest{
+		JSONRPC:  jsonRPCVersion,
+		ID:       json.RawMessage(fmt.Sprint(id)),
+		Method:   string(e.Name),
+		Params:   rpcParams(e.Data),
+		Metadata: e.Metadata,
+	}
+}
+
+// rpcParams returns the payload as JSON-RPC params, which must be structured values.
+// Payloads which are not objects are wrapped in an array, so arrays
+// can be told apart from wrapped values, see rpcRequest.event.
+func rpcParams(data string) json.RawMessage {
+	trimmed := bytes.TrimSpace([]byte(data))
+	if len(trimmed) == 0 || string(trimmed) == "null" {
+		return nil
+	}
+	if json.Valid(trimmed) {
+		if trimmed[0] == '{' {
+			return trimmed
+		}
+		return json.RawMessage("[" + string(trimmed) + "]")
+	}
+	dat, _ := json.Marshal([]string{data})
+	return dat
+}
+
+// event decodes the request as an Event, with the metadata of the request.
+// Params which are a one element array are unwrapped, see rpcParams.
+func (r rpcRequest) event() *Event {
+	params := r.Params
+	var positional []json.RawMessage
+	if err := json.Unmarshal(params, &positional); err == nil && len(positional) == 1 {
+		params = positional[0]
+	}
+	return &Event{Name: EventType(r.Method), Data: string(params), Metadata: r.Metadata}
+}
+
+// id returns the numeric request id of the response
+func (r rpcResponse) id() (uint64, bool) {
+	var id uint64
+	return id, json.Unmarshal(r.ID, &id) == nil
+}
+
+// eventResponse decodes the JSON-RPC response as an EventResponse.
+// Results which are objects with any of the state, data or log fields
+// are mapped to the EventResponse fields, any other result is used as Data.
+// Method not found errors get StateUnhandled.
+func (r rpcResponse) eventResponse() (EventResponse, error) {
+	resp := EventResponse{}
+	if r.Error != nil {
+		decodeRPCResult(r.Error.Data, &resp)
+		resp.Error = r.Error.Message
+		if r.Error.Code == RPCMethodNotFound {
+			resp.State = StateUnhandled
+		}
+		return resp, r.Error
+	}
+	decodeRPCResult(r.Result, &resp)
+	return resp, nil
+}
+
+func decodeRPCResult(raw json.RawMessage, resp *EventResponse) {
+	if len(raw) == 0 {
+		return
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		resp.Data = string(raw)
+		return
+	}
+	state, hasState := fields["state"]
+	data, hasData := fields["data"]
+	logs, hasLogs := fields["log"]
+	if !hasState && !hasData && !hasLogs {
+		resp.Data = string(raw)
+		return
+	}
+	json.Unmarshal(state, &resp.State)
+	json.Unmarshal(logs, &resp.Logs)
+	if err := json.Unmarshal(data, &resp.Data); err != nil && hasData {
+		resp.Data = string(data)
+	}
+}
+
+// newRPCResponse encodes the EventResponse as a JSON-RPC response
+func newRPCResponse(id json.RawMessage, resp EventResponse) rpcResponse {
+	result, _ := json.Marshal(rpcResult{State: resp.State, Data: resp.Data, Logs: resp.Logs})
+	r := rpcResponse{JSONRPC: jsonRPCVersion, ID: id}
+	if resp.Errored() {
+		r.Error = &RPCError{Code: RPCPluginError, Message: resp.Error, Data: result}
+	} else {
+		r.Result = result
+	}
+	return r
+}
+
+// newRPCError returns a JSON-RPC error response
+func newRPCError(id json.RawMessage, code int, msg string) rpcResponse {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return rpcResponse{JSONRPC: jsonRPCVersion, ID: id, Error: &RPCError{Code: code, Message: msg}}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SkipReason describes why a plugin candidate was not loaded
+type SkipReason string
+
+const (
+	// SkipNotExecutable is used for files without the executable bit, and directories
+	SkipNotExecutable SkipReason = "not executable"
+	// SkipDuplicate is used for plugins conflicting by name or path with one already loaded
+	SkipDuplicate SkipReason = "duplicate name"
+	// SkipShadowed is used for plugins found also in an earlier path
+	SkipShadowed SkipReason = "shadowed by earlier path"
+	// SkipBrokenSymlink is used for symlinks pointing to missing files
+	SkipBrokenSymlink SkipReason = "broken symlink"
+	// SkipUnreadable is used for candidates which could not be inspected
+	SkipUnreadable SkipReason = "unreadable"
+)
+
+// SkippedPlugin is a plugin candidate which was not loaded
+type SkippedPlugin struct {
+	Name   string
+	Path   string
+	Reason SkipReason
+	// Err is the underlying error, if any
+	Err error
+}
+
+// LoadReport describes the outcome of loading plugins
+type LoadReport struct {
+	Loaded  []Plugin
+	Skipped []SkippedPlugin
+	// Errors are failures not related to a specific candidate, e.g. invalid paths
+	Errors []error
+}
+
+// AutoloadWithReport is like Autoload, but returns a report of the plugins
+// loaded, of the candidates skipped and of the errors encountered.
+// Manifest files found on the paths are ignored, see LoadManifests.
+func (m *Manager) AutoloadWithReport(prefix string, extensionpath ...string) LoadReport {
+	report := LoadReport{}
+	projPrefix := fmt.Sprintf("%s-", prefix)
+	paths := strings.Split(os.Getenv("PATH"), ":")
+
+	for _, path := range extensionpath {
+		if filepath.IsAbs(path) {
+			paths = append(paths, path)
+			continue
+		}
+
+		rel, err := relativeToCwd(path)
+		if err != nil {
+			report.Errors = append(report.Errors, errors.Wrapf(err, "while resolving %s", path))
+			continue
+		}
+		paths = append(paths, rel)
+	}
+
+	found := map[string]string{}
+	for _, p := range uniquePaths(paths) {
+		matches, err := filepath.Glob(filepath.Join(p, fmt.Sprintf("%s*", projPrefix)))
+		if err != nil {
+			report.Errors = append(report.Errors, errors.Wrapf(err, "while scanning %s", p))
+			continue
+		}
+		for _, ma := range matches {
+			if isManifest(ma) {
+				continue
+			}
+			short := strings.TrimPrefix(filepath.Base(ma), projPrefix)
+			m.loadCandidate(&report, found, short, ma)
+		}
+	}
+	return report
+}
+
+// LoadWithReport is like Load, but returns a report of the plugins
+// loaded and of the candidates skipped
+func (m *Manager) LoadWithReport(extname ...string) LoadReport {
+	report := LoadReport{}
+	paths := strings.Split(os.Getenv("PATH"), ":")
+
+	found := map[string]string{}
+	for _, p := range uniquePaths(paths) {
+		for _, n := range extname {
+			path := filepath.Join(p, n)
+			if _, err := os.Lstat(path); os.IsNotExist(err) {
+				continue
+			}
+			m.loadCandidate(&report, found, n, path)
+		}
+	}
+	return report
+}
+
+// uniquePaths returns the paths without the ones listed more than once,
+// which would otherwise shadow themselves
+func uniquePaths(paths []string) []string {
+	var res []string
+	seen := map[string]bool{}
+	for _, p := range paths {
+		clean := filepath.Clean(p)
+		if !seen[clean] {
+			seen[clean] = true
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// loadCandidate inserts the plugin found at path, recording the outcome in the report.
+// found tracks the plugins found so far by name, to detect shadowed ones.
+func (m *Manager) loadCandidate(report *LoadReport, found map[string]string, name, path string) {
+	skip := func(reason SkipReason, err error) {
+		report.Skipped = append(report.Skipped, SkippedPlugin{Name: name, Path: path, Reason: reason, Err: err})
+	}
+
+	linfo, err := os.Lstat(path)
+	if err != nil {
+		skip(SkipUnreadable, err)
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		if linfo.Mode()&os.ModeSymlink != 0 {
+			skip(SkipBrokenSymlink, err)
+		} else {
+			skip(SkipUnreadable, err)
+		}
+		return
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		skip(SkipNotExecutable, nil)
+		return
+	}
+
+	if first, ok := found[name]; ok {
+		skip(SkipShadowed, fmt.Errorf("shadowed by %s", first))
+		return
+	}
+	found[name] = path
+
+	p := Plugin{Name: name, Executable: path}
+	if !m.addPlugin(p) {
+		skip(SkipDuplicate, nil)
+		return
+	}
+	report.Loaded = append(report.Loaded, p)
+}
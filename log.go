@@ -0,0 +1,169 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log entry
+type LogLevel string
+
+const (
+	LogDebug LogLevel = "debug"
+	LogInfo  LogLevel = "info"
+	LogWarn  LogLevel = "warn"
+	LogError LogLevel = "error"
+)
+
+// LogEntry is a structured log line of a plugin
+type LogEntry struct {
+	Level   LogLevel  `json:"level"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+func (l LogEntry) String() string {
+	return fmt.Sprintf("%s: %s", l.Level, l.Message)
+}
+
+// Logger collects the logs of a handler, which the factory returns in the response.
+// It is safe for concurrent use, and writing to it logs at the info level.
+type Logger struct {
+	mu      sync.Mutex
+	entries []LogEntry
+}
+
+type loggerKey struct{}
+
+// Logger returns the logger of the event. Handlers run by a PluginFactory
+// get a logger whose output is returned in the response, otherwise the
+// returned logger discards its output.
+func (e Event) Logger() *Logger {
+	if l, ok := e.Context().Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return &Logger{}
+}
+
+// withLogger returns a copy of the event bound to the logger
+func (e Event) withLogger(l *Logger) *Event {
+	return e.WithContext(context.WithValue(e.Context(), loggerKey{}, l))
+}
+
+// Log adds an entry at the given level
+func (l *Logger) Log(level LogLevel, args ...interface{}) {
+	l.add(level, strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+}
+
+// Logf adds a formatted entry at the given level
+func (l *Logger) Logf(level LogLevel, format string, args ...interface{}) {
+	l.add(level, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Debug(args ...interface{})                 { l.Log(LogDebug, args...) }
+func (l *Logger) Debugf(format string, args ...interface{}) { l.Logf(LogDebug, format, args...) }
+func (l *Logger) Info(args ...interface{})                  { l.Log(LogInfo, args...) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.Logf(LogInfo, format, args...) }
+func (l *Logger) Warn(args ...interface{})                  { l.Log(LogWarn, args...) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.Logf(LogWarn, format, args...) }
+func (l *Logger) Error(args ...interface{})                 { l.Log(LogError, args...) }
+func (l *Logger) Errorf(format string, args ...interface{}) { l.Logf(LogError, format, args...) }
+
+// Write logs each line written at the info level, so the Logger can be used as an io.Writer
+func (l *Logger) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		l.add(LogInfo, line)
+	}
+	return len(p), nil
+}
+
+func (l *Logger) add(level LogLevel, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, LogEntry{Level: level, Message: msg, Time: time.Now().UTC()})
+}
+
+// Entries returns the entries logged so far
+func (l *Logger) Entries() []LogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]LogEntry{}, l.entries...)
+}
+
+// String returns the entries logged so far, one per line
+func (l *Logger) String() string {
+	var b strings.Builder
+	for _, e := range l.Entries() {
+		b.WriteString(e.String())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// CaptureOutput returns a handler capturing what h writes to os.Stdout and
+// os.Stderr in the response logs. Since it swaps the process-wide files it
+// is not safe with goroutines printing concurrently, and is meant for
+// handlers which can't use the event Logger.
+func CaptureOutput(h PluginHandler) PluginHandler {
+	return func(e *Event) EventResponse {
+		old := os.Stdout
+		oldErr := os.Stderr
+
+		re, ww, err := os.Pipe()
+		if err != nil {
+			return EventResponse{Error: "while capturing output: " + err.Error()}
+		}
+
+		os.Stdout = ww
+		os.Stderr = ww
+		outC := make(chan string)
+
+		// copy the output in a separate goroutine so printing can't block indefinitely
+		go func() {
+			var buf bytes.Buffer
+			io.Copy(&buf, re)
+			outC <- buf.String()
+		}()
+
+		restore := func() string {
+			ww.Close()
+			os.Stdout = old
+			os.Stderr = oldErr
+			out := <-outC
+			re.Close()
+			return out
+		}
+		defer func() {
+			// restoring the real stdout if the handler panics
+			if r := recover(); r != nil {
+				if out := restore(); out != "" {
+					e.Logger().Write([]byte(out))
+				}
+				panic(r)
+			}
+		}()
+
+		resp := h(e)
+		resp.Logs = restore() + resp.Logs
+		return resp
+	}
+}
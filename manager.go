@@ -14,21 +14,98 @@ limitations under the License.
 package pluggable
 
 import (
-	"fmt"
+	"context"
 	"os"
 	"path/filepath"
-	"strings"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/chuckpreslar/emission"
 	"github.com/pkg/errors"
 )
 
+const (
+	// EventPluginAdded is emitted on the Manager bus when a plugin is added
+	EventPluginAdded EventType = "pluggable.plugin.added"
+	// EventPluginRemoved is emitted on the Manager bus when a plugin is removed
+	EventPluginRemoved EventType = "pluggable.plugin.removed"
+)
+
 // Manager describes a set of Plugins and
 // a set of Event types which are subscribed to a message bus
 type Manager struct {
 	Plugins []Plugin
 	Events  []EventType
 	Bus     *emission.Emitter
+
+	// Timeout is the default execution timeout for plugins which don't
+	// specify one. Zero means no timeout.
+	Timeout time.Duration
+
+	// Schemas are the schemas validating the data of the events published
+	// and of the responses of the plugins, by event
+	Schemas map[EventType]EventSchema
+
+	// Source identifies the Manager in the metadata of the events it publishes
+	Source string
+
+	// Dispatch is the way events are dispatched to the plugins
+	Dispatch DispatchMode
+
+	// Interceptors are called around each plugin invocation, see Interceptor
+	Interceptors []Interceptor
+
+	// Breaker opens the circuit of plugins which keep failing, skipping them
+	// for a while. When nil, plugins are always run.
+	Breaker *CircuitBreaker
+
+	// Retry is the default retry policy for plugins which don't specify one
+	Retry *RetryPolicy
+
+	// Policy is used by Ask to reach a decision
+	Policy Policy
+
+	// Encodings are the codecs to use with the plugins, by preference.
+	// The first one supported by a plugin is negotiated during the handshake.
+	Encodings []string
+
+	// Handshake enables the handshake with plugins on Subscribe, so they are subscribed
+	// only to the events they declare. Plugins which don't support it get all the events.
+	Handshake bool
+
+	// Concurrency limits the plugin executions running at the same time,
+	// with as many workers. Zero means no limit.
+	Concurrency int
+	// QueueSize is the number of executions which can wait for a worker
+	// when Concurrency is set.
+	QueueSize int
+	// Backpressure is the behavior when the queue is full
+	Backpressure Backpressure
+	// PluginConcurrency limits the executions of each plugin running
+	// at the same time. Zero means no limit.
+	PluginConcurrency int
+
+	mu      sync.Mutex
+	pool    *pool
+	daemons map[string]*daemon
+	// circuits are the circuits of the plugins, by id
+	circuits map[string]*circuit
+	// subscriptions maps the events to the plugins subscribed to them.
+	// It is nil until the Manager is subscribed to a bus.
+	subscriptions map[EventType][]Plugin
+	// dispatchers are the listeners bound to each bus, by event
+	dispatchers map[*emission.Emitter]map[EventType]func(*Event)
+	// listeners are the user listeners bound to the Manager bus
+	listeners []listener
+	// responsePatterns are the patterns Response listeners are bound to
+	responsePatterns []EventType
+}
+
+// listener is a function bound to an event of the Manager bus
+type listener struct {
+	event string
+	fn    interface{}
 }
 
 // NewManager returns a manager instance with a new bus and
@@ -39,7 +116,8 @@ func NewManager(events []EventType) *Manager {
 	}
 }
 
-// Register subscribes the plugin to its internal bus
+// Register subscribes the plugin to its internal bus.
+// Calling it more than once doesn't subscribe the plugins twice.
 func (m *Manager) Register() *Manager {
 	m.Subscribe(m.Bus)
 	return m
@@ -48,109 +126,575 @@ func (m *Manager) Register() *Manager {
 // Publish is a wrapper around NewEvent and the Manager internal Bus publishing system
 // It accepts optionally a list of functions that are called with the plugin result (only once)
 func (m *Manager) Publish(event EventType, obj interface{}) (*Manager, error) {
-	ev, err := NewEvent(event, obj)
-	if err == nil && ev != nil {
-		m.Bus.Emit(string(ev.Name), ev)
+	return m.PublishContext(context.Background(), event, obj)
+}
+
+// PublishContext is like Publish, but the given context is propagated to the plugins,
+// which are killed if it is cancelled before they complete.
+// With BackpressureFail, it returns ErrQueueFull for the plugins which could not be queued.
+func (m *Manager) PublishContext(ctx context.Context, event EventType, obj interface{}) (*Manager, error) {
+	ev, err := m.event(event, obj)
+	if err != nil || ev == nil {
+		return m, err
+	}
+	return m.publish(ev.WithContext(ctx))
+}
+
+// PublishEvent publishes an event built by the caller, for instance to set its metadata.
+// Missing metadata is filled in, and the event context is propagated to the plugins.
+func (m *Manager) PublishEvent(e *Event) (*Manager, error) {
+	ev := e.Copy()
+	if ev.Metadata == nil {
+		ev.Metadata = NewEventMetadata()
+	} else {
+		md := *ev.Metadata
+		if md.ID == "" {
+			md.ID = newEventID()
+		}
+		if md.Timestamp.IsZero() {
+			md.Timestamp = time.Now().UTC()
+		}
+		if md.CorrelationID == "" {
+			md.CorrelationID = md.ID
+		}
+		ev.Metadata = &md
+	}
+	if ev.Metadata.Source == "" {
+		ev.Metadata.Source = m.Source
+	}
+	if err := m.validateEvent(ev); err != nil {
+		return m, err
+	}
+	return m.publish(ev)
+}
+
+// publish emits the event, see PublishContext
+func (m *Manager) publish(ev *Event) (*Manager, error) {
+	c := &collector{}
+	ev.results = c
+	m.emit(ev)
+
+	c.Lock()
+	defer c.Unlock()
+	var errs MultiError
+	for _, r := range c.results {
+		if errors.Is(r.Error, ErrQueueFull) {
+			errs = append(errs, errors.Wrapf(r.Error, "plugin %s", r.Plugin.Name))
+		}
+	}
+	return m, errs.ErrorOrNil()
+}
+
+// PluginResult is the outcome of running a plugin against an event
+type PluginResult struct {
+	Plugin   Plugin
+	Response EventResponse
+	Error    error
+}
+
+// collector gathers the results of the plugins for an event
+type collector struct {
+	sync.Mutex
+	results []PluginResult
+
+	// pipeline forces the pipeline dispatch for the event
+	pipeline bool
+	// final is the outcome of the pipeline
+	final EventResponse
+}
+
+func (c *collector) add(p Plugin, r EventResponse, err error) {
+	c.Lock()
+	defer c.Unlock()
+	if r.Unhandled() {
+		// Plugins are not failing for the events they don't handle
+		err = nil
+	} else if err == nil && r.Errored() {
+		err = errors.New(r.Error)
+	}
+	c.results = append(c.results, PluginResult{Plugin: p, Response: r, Error: err})
+}
+
+// PublishAndCollect publishes the event and waits for all the subscribed plugins to complete.
+// It returns the results in the order the plugins are listed in the Manager, and an error
+// aggregating the failures of all the plugins, if any.
+// Listeners bound with Response are called as well.
+func (m *Manager) PublishAndCollect(event EventType, obj interface{}) ([]PluginResult, error) {
+	ev, err := m.event(event, obj)
+	if err != nil {
+		return nil, err
+	}
+	return m.collect(ev)
+}
+
+// collect publishes the event and returns the results of the plugins, see PublishAndCollect
+func (m *Manager) collect(ev *Event) ([]PluginResult, error) {
+	c := &collector{}
+	ev.results = c
+	m.emit(ev)
+	return m.gather(c)
+}
+
+// gather returns the results of the collector sorted, and the errors of the plugins
+func (m *Manager) gather(c *collector) ([]PluginResult, error) {
+	c.Lock()
+	defer c.Unlock()
+	results := c.results
+	m.sortResults(results)
+
+	var errs MultiError
+	for _, r := range results {
+		if r.Error != nil {
+			errs = append(errs, errors.Wrapf(r.Error, "plugin %s", r.Plugin.Name))
+		}
+	}
+	return results, errs.ErrorOrNil()
+}
+
+// sortResults orders results following the plugins order of the Manager
+func (m *Manager) sortResults(results []PluginResult) {
+	m.mu.Lock()
+	plugins := m.Plugins
+	m.mu.Unlock()
+
+	index := func(p Plugin) int {
+		for i, pp := range plugins {
+			if pp.Name == p.Name && pp.Executable == p.Executable {
+				return i
+			}
+		}
+		return len(plugins)
 	}
-	return m, err
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := index(results[i].Plugin), index(results[j].Plugin)
+		if a != b {
+			return a < b
+		}
+		return results[i].Plugin.Name < results[j].Plugin.Name
+	})
 }
 
-// Response binds a set of listeners to an event type. The listeners are called for each result from
-// every plugin when Publish is called.
+// Response binds a set of listeners to an event type, or to an event pattern. The listeners are called
+// for each result from every plugin when Publish is called.
 func (m *Manager) Response(event EventType, listener ...func(p *Plugin, r *EventResponse)) *Manager {
-	ev, _ := NewEvent(event, nil)
+	if event.IsPattern() {
+		m.mu.Lock()
+		found := false
+		for _, p := range m.responsePatterns {
+			found = found || p == event
+		}
+		if !found {
+			m.responsePatterns = append(m.responsePatterns, event)
+		}
+		m.mu.Unlock()
+	}
+
+	ev := Event{Name: event}
 	for _, l := range listener {
-		m.Bus.On(string(ev.ResponseEventName("results")), l)
+		m.on(string(ev.ResponseEventName("results")), l)
 	}
 	return m
 }
 
-func (m *Manager) propagateEvent(p Plugin) func(e *Event) {
-	return func(e *Event) {
-		resp, err := p.Run(*e)
-		r := &resp
-		if err != nil && !resp.Errored() {
-			resp.Error = err.Error()
+// on binds the listener to the Manager bus, keeping track of it
+func (m *Manager) on(event string, fn interface{}) {
+	m.mu.Lock()
+	m.listeners = append(m.listeners, listener{event: event, fn: fn})
+	m.mu.Unlock()
+	m.Bus.On(event, fn)
+}
+
+// propagateEvent runs the event on the plugin, delivering the response to
+// the Response listeners, and returns it. It returns false if the plugin
+// was skipped by an interceptor.
+func (m *Manager) propagateEvent(p Plugin, e *Event) (EventResponse, bool) {
+	resp, err := m.intercept(e.Context(), p, *e)
+	if errors.Is(err, ErrSkipPlugin) {
+		return resp, false
+	}
+	if err == nil {
+		err = m.validateResponse(e, resp)
+	}
+	r := &resp
+	if err != nil && !resp.Errored() {
+		resp.Error = err.Error()
+	}
+	resp.Event = e.Name
+	if resp.Metadata == nil && e.Metadata != nil {
+		md := *e.Metadata
+		resp.Metadata = &md
+	}
+	if e.results != nil {
+		e.results.add(p, resp, err)
+	}
+	m.emitResults(e, &p, r)
+	return resp, true
+}
+
+// run executes the event on the plugin, within the Manager concurrency limits
+func (m *Manager) run(ctx context.Context, p Plugin, e Event) (EventResponse, error) {
+	var resp EventResponse
+	var err error
+	if perr := m.workers().do(ctx, p.id(), func() { resp, err = m.execute(ctx, p, e) }); perr != nil {
+		resp.Error = "error while executing plugin: " + perr.Error()
+		return resp, errors.Wrap(perr, "while queueing plugin")
+	}
+	return resp, err
+}
+
+// execute runs the event on the plugin, using its persistent process if it has one
+func (m *Manager) execute(ctx context.Context, p Plugin, e Event) (EventResponse, error) {
+	if p.Timeout == 0 && m.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.Timeout)
+		defer cancel()
+	}
+
+	if !p.Persistent {
+		return p.RunContext(ctx, e)
+	}
+
+	m.mu.Lock()
+	if m.daemons == nil {
+		m.daemons = map[string]*daemon{}
+	}
+	key := p.id()
+	d, ok := m.daemons[key]
+	if !ok {
+		d = newDaemon(p)
+		m.daemons[key] = d
+	}
+	m.mu.Unlock()
+
+	return d.run(ctx, e)
+}
+
+// Close unsubscribes the Manager from all the buses, removes the listeners bound
+// to its bus and stops the persistent plugins and the workers. The Manager can be registered again afterwards.
+//
+// Listeners are removed from the buses by function, so Close removes the listeners
+// of other Managers subscribed to the same events on the same bus as well.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	daemons := m.daemons
+	m.daemons = nil
+	workers := m.pool
+	m.pool = nil
+	for b, dispatchers := range m.dispatchers {
+		for e, d := range dispatchers {
+			b.Off(string(e), d)
 		}
-		m.Bus.Emit(string(e.ResponseEventName("results")), &p, r)
 	}
+	m.dispatchers = nil
+	m.subscriptions = nil
+	for _, l := range m.listeners {
+		m.Bus.Off(l.event, l.fn)
+	}
+	m.listeners = nil
+	m.responsePatterns = nil
+	m.mu.Unlock()
+
+	if workers != nil {
+		workers.stop()
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range daemons {
+		wg.Add(1)
+		go func(d *daemon) {
+			defer wg.Done()
+			d.stop()
+		}(d)
+	}
+	wg.Wait()
+	return nil
 }
 
-// Subscribe subscribes the plugin to the events in the given bus
+// Subscribe subscribes the plugin to the events in the given bus.
+// Events matched only by patterns of the Manager events are dispatched when
+// published with the Manager Publish methods. As those publish on the Manager
+// Bus, Subscribe panics if the Manager events contain patterns and b is another bus.
 func (m *Manager) Subscribe(b *emission.Emitter) *Manager {
-	for _, p := range m.Plugins {
+	if b != m.Bus {
+		m.mu.Lock()
 		for _, e := range m.Events {
-			b.On(string(e), m.propagateEvent(p))
+			if e.IsPattern() {
+				m.mu.Unlock()
+				panic(errors.Errorf("event pattern %s can only be subscribed on the Manager Bus", e))
+			}
+		}
+		m.mu.Unlock()
+	}
+
+	if m.Handshake {
+		m.describe()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.subscriptions == nil {
+		m.subscriptions = map[EventType][]Plugin{}
+	}
+	for _, p := range m.Plugins {
+		m.subscribe(p)
+	}
+	m.bus(b)
+	for _, e := range m.Events {
+		// Patterns are bound to the events matching them as they are published
+		if !e.IsPattern() {
+			m.bind(b, e)
 		}
 	}
 	return m
 }
 
-func relativeToCwd(p string) (string, error) {
-	cwd, err := os.Getwd()
-	if err != nil {
-		return "", errors.Wrap(err, "failed getting current work directory")
+// subscribe adds the plugin to the subscribers of the events it handles.
+// It must be called with the Manager locked.
+func (m *Manager) subscribe(p Plugin) {
+	for _, e := range m.Events {
+		// Plugins are filtered by the events matching patterns as they are dispatched
+		if !e.IsPattern() && !p.Handles(e) {
+			continue
+		}
+		subscribed := false
+		for _, s := range m.subscriptions[e] {
+			if s.Name == p.Name && s.Executable == p.Executable {
+				subscribed = true
+				break
+			}
+		}
+		if !subscribed {
+			m.subscriptions[e] = append(m.subscriptions[e], p)
+		}
+	}
+}
+
+// unsubscribe removes the plugin from the subscribers of all the events.
+// It must be called with the Manager locked.
+func (m *Manager) unsubscribe(p Plugin) {
+	for e, plugins := range m.subscriptions {
+		var kept []Plugin
+		for _, s := range plugins {
+			if s.Name != p.Name || s.Executable != p.Executable {
+				kept = append(kept, s)
+			}
+		}
+		m.subscriptions[e] = kept
 	}
+}
 
-	return filepath.Join(cwd, p), nil
+// bind listens for the event on the bus, if not already listening.
+// It must be called with the Manager locked.
+func (m *Manager) bind(b *emission.Emitter, e EventType) {
+	dispatchers := m.bus(b)
+	if _, ok := dispatchers[e]; ok {
+		return
+	}
+	d := m.dispatcher(e)
+	dispatchers[e] = d
+	b.On(string(e), d)
 }
 
-func (m *Manager) insertPlugin(p Plugin) {
-	for _, i := range m.Plugins {
-		// We don't want any ambiguity here.
-		// Binary plugins must be unique in PATH and Name
-		if i.Executable == p.Executable || i.Name == p.Name {
+// bus returns the dispatchers bound to the bus, marking it as subscribed.
+// It must be called with the Manager locked.
+func (m *Manager) bus(b *emission.Emitter) map[EventType]func(*Event) {
+	if m.dispatchers == nil {
+		m.dispatchers = map[*emission.Emitter]map[EventType]func(*Event){}
+	}
+	if m.dispatchers[b] == nil {
+		m.dispatchers[b] = map[EventType]func(*Event){}
+	}
+	return m.dispatchers[b]
+}
+
+// subscribers returns the plugins currently subscribed to the event
+func (m *Manager) subscribers(e EventType) []Plugin {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var res []Plugin
+	seen := map[string]bool{}
+	for _, event := range m.Events {
+		if !e.Matches(event) {
+			continue
+		}
+		for _, p := range m.subscriptions[event] {
+			if !seen[p.id()] && p.Handles(e) {
+				seen[p.id()] = true
+				res = append(res, p)
+			}
+		}
+	}
+	return res
+}
+
+// dispatcher returns the bus listener which runs the event on all its subscribers
+func (m *Manager) dispatcher(event EventType) func(e *Event) {
+	return func(e *Event) {
+		plugins := m.subscribers(event)
+		if m.Dispatch == DispatchPipeline || (e.results != nil && e.results.pipeline) {
+			m.pipeline(e, plugins)
 			return
 		}
+
+		var wg sync.WaitGroup
+		for _, p := range plugins {
+			wg.Add(1)
+			go func(p Plugin) {
+				defer wg.Done()
+				m.propagateEvent(p, e)
+			}(p)
+		}
+		wg.Wait()
 	}
-	m.Plugins = append(m.Plugins, p)
 }
 
-// Autoload automatically loads plugins binaries prefixed by 'prefix' in the current path
-// optionally takes a list of paths to look also into
-func (m *Manager) Autoload(prefix string, extensionpath ...string) *Manager {
-	projPrefix := fmt.Sprintf("%s-", prefix)
-	paths := strings.Split(os.Getenv("PATH"), ":")
+// RemovePlugin unsubscribes the plugin with the given name from all the events, and removes
+// it from the Manager, stopping it if it is persistent. It returns false if there was no such plugin.
+func (m *Manager) RemovePlugin(name string) bool {
+	return len(m.removePlugins(func(p Plugin) bool { return p.Name == name })) > 0
+}
 
-	for _, path := range extensionpath {
-		if filepath.IsAbs(path) {
-			paths = append(paths, path)
-			continue
+// Unsubscribe removes the event from the Manager events, and unsubscribes all the
+// plugins from it. Listeners bound with Response are kept. See Close about
+// buses shared between Managers.
+func (m *Manager) Unsubscribe(event EventType) *Manager {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var events []EventType
+	for _, e := range m.Events {
+		if e != event {
+			events = append(events, e)
 		}
+	}
+	m.Events = events
 
-		rel, err := relativeToCwd(path)
-		if err != nil {
-			continue
+	delete(m.subscriptions, event)
+	for b, dispatchers := range m.dispatchers {
+		for e, d := range dispatchers {
+			if !m.routed(e) {
+				b.Off(string(e), d)
+				delete(dispatchers, e)
+			}
+		}
+	}
+	return m
+}
+
+// addPlugin loads the plugin and subscribes it if the Manager is already subscribed to a bus.
+// It returns false if the plugin conflicts with one already loaded.
+func (m *Manager) addPlugin(p Plugin) bool {
+	if m.Handshake && p.Description == nil {
+		if d, err := m.Describe(p); err == nil {
+			m.described(&p, d)
 		}
-		paths = append(paths, rel)
 	}
 
-	for _, p := range paths {
-		matches, err := filepath.Glob(filepath.Join(p, fmt.Sprintf("%s*", projPrefix)))
-		if err != nil {
+	m.mu.Lock()
+	ok := m.insertPlugin(p)
+	if ok && m.subscriptions != nil {
+		m.subscribe(p)
+	}
+	m.mu.Unlock()
+
+	if ok {
+		m.Bus.Emit(string(EventPluginAdded), &p)
+	}
+	return ok
+}
+
+// removePlugins unloads and unsubscribes the plugins matching the given function,
+// stopping them if they are persistent. It returns the plugins removed.
+func (m *Manager) removePlugins(match func(p Plugin) bool) []Plugin {
+	var removed, kept []Plugin
+	var daemons []*daemon
+
+	m.mu.Lock()
+	for _, p := range m.Plugins {
+		if !match(p) {
+			kept = append(kept, p)
 			continue
 		}
-		for _, ma := range matches {
-			short := strings.TrimPrefix(filepath.Base(ma), projPrefix)
-			m.insertPlugin(Plugin{Name: short, Executable: ma})
+		removed = append(removed, p)
+		m.unsubscribe(p)
+		key := p.id()
+		if d, ok := m.daemons[key]; ok {
+			daemons = append(daemons, d)
+			delete(m.daemons, key)
 		}
+		delete(m.circuits, key)
+	}
+	m.Plugins = kept
+	m.mu.Unlock()
+
+	for _, d := range daemons {
+		d.stop()
+	}
+	for i := range removed {
+		m.Bus.Emit(string(EventPluginRemoved), &removed[i])
+	}
+	return removed
+}
+
+// OnPluginAdded binds a set of listeners called when a plugin is added while
+// the Manager is running, e.g. by Watch
+func (m *Manager) OnPluginAdded(listener ...func(p *Plugin)) *Manager {
+	for _, l := range listener {
+		m.on(string(EventPluginAdded), l)
 	}
 	return m
 }
 
-// Load finds the binaries given as parameter (without path) and scan the system $PATH to retrieve those automatically
-func (m *Manager) Load(extname ...string) *Manager {
-	paths := strings.Split(os.Getenv("PATH"), ":")
-
-	for _, p := range paths {
-		for _, n := range extname {
-			path := filepath.Join(p, n)
-			_, err := os.Lstat(path)
-			if err != nil {
-				continue
-			}
-			m.insertPlugin(Plugin{Name: n, Executable: path})
+// OnPluginRemoved binds a set of listeners called when a plugin is removed while
+// the Manager is running, e.g. by Watch
+func (m *Manager) OnPluginRemoved(listener ...func(p *Plugin)) *Manager {
+	for _, l := range listener {
+		m.on(string(EventPluginRemoved), l)
+	}
+	return m
+}
+
+func relativeToCwd(p string) (string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", errors.Wrap(err, "failed getting current work directory")
+	}
+
+	return filepath.Join(cwd, p), nil
+}
+
+// insertPlugin adds the plugin, keeping the plugins ordered by priority.
+// It returns false if the plugin conflicts with one already loaded.
+// It must be called with the Manager locked.
+func (m *Manager) insertPlugin(p Plugin) bool {
+	for _, i := range m.Plugins {
+		// We don't want any ambiguity here.
+		// Binary plugins must be unique in PATH and Name
+		if i.Executable == p.Executable || i.Name == p.Name {
+			return false
 		}
 	}
+	pos := len(m.Plugins)
+	for pos > 0 && m.Plugins[pos-1].Priority < p.Priority {
+		pos--
+	}
+	m.Plugins = append(m.Plugins, Plugin{})
+	copy(m.Plugins[pos+1:], m.Plugins[pos:])
+	m.Plugins[pos] = p
+	return true
+}
+
+// Autoload automatically loads plugins binaries prefixed by 'prefix' in the current path
+// optionally takes a list of paths to look also into.
+// Manifest files found on the paths are ignored, see LoadManifests.
+func (m *Manager) Autoload(prefix string, extensionpath ...string) *Manager {
+	m.AutoloadWithReport(prefix, extensionpath...)
+	return m
+}
+
+// Load finds the binaries given as parameter (without path) and scan the system $PATH to retrieve those automatically
+func (m *Manager) Load(extname ...string) *Manager {
+	m.LoadWithReport(extname...)
 	return m
 }
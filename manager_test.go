@@ -0,0 +1,145 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/mudler/go-pluggable"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Manager", func() {
+	Context("managing subscriptions", func() {
+		var pluginFile, pluginFile2 *os.File
+		var m *Manager
+		var calls int
+		var mu sync.Mutex
+
+		BeforeEach(func() {
+			var err error
+			pluginFile, err = ioutil.TempFile(os.TempDir(), "tests")
+			Expect(err).Should(BeNil())
+			pluginFile.Close()
+			os.Remove(pluginFile.Name())
+			pluginFile2, err = ioutil.TempFile(os.TempDir(), "tests")
+			Expect(err).Should(BeNil())
+			pluginFile2.Close()
+			os.Remove(pluginFile2.Name())
+
+			script := `echo "{ \"state\": \"$1\" }"`
+			writePlugin(filepath.Dir(pluginFile.Name()), filepath.Base(pluginFile.Name()), script)
+			writePlugin(filepath.Dir(pluginFile2.Name()), filepath.Base(pluginFile2.Name()), script)
+
+			m = NewManager([]EventType{PackageInstalled, "package.remove"})
+			m.Plugins = []Plugin{{Name: "test", Executable: pluginFile.Name()},
+				{Name: "test2", Executable: pluginFile2.Name()}}
+
+			calls = 0
+			m.Response(PackageInstalled, func(p *Plugin, r *EventResponse) {
+				mu.Lock()
+				defer mu.Unlock()
+				calls++
+			})
+		})
+
+		AfterEach(func() {
+			m.Close()
+			os.Remove(pluginFile.Name())
+			os.Remove(pluginFile2.Name())
+		})
+
+		count := func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return calls
+		}
+
+		It("doesn't report events the plugins don't handle as errors", func() {
+			writePlugin(filepath.Dir(pluginFile2.Name()), filepath.Base(pluginFile2.Name()),
+				`echo '{ "state": "unhandled", "error": "unhandled event package.install" }'`)
+			m.Register()
+
+			results, err := m.PublishAndCollect(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(results)).To(Equal(2))
+			Expect(results[0].Response.State).To(Equal(string(PackageInstalled)))
+			Expect(results[1].Response.Unhandled()).To(BeTrue())
+			Expect(results[1].Error).ToNot(HaveOccurred())
+
+			p, err := m.PublishAsync(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = p.Wait()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("registers plugins once", func() {
+			m.Register()
+			m.Register()
+
+			m.Publish(PackageInstalled, "foo")
+			Expect(count()).To(Equal(2))
+		})
+
+		It("removes plugins", func() {
+			m.Register()
+			Expect(m.RemovePlugin("test")).To(BeTrue())
+			Expect(m.RemovePlugin("test")).To(BeFalse())
+			Expect(len(m.Plugins)).To(Equal(1))
+
+			m.Publish(PackageInstalled, "foo")
+			Expect(count()).To(Equal(1))
+		})
+
+		It("unsubscribes events", func() {
+			m.Register()
+			m.Unsubscribe(PackageInstalled)
+			Expect(m.Events).To(Equal([]EventType{"package.remove"}))
+
+			m.Publish(PackageInstalled, "foo")
+			Expect(count()).To(Equal(0))
+
+			results, err := m.PublishAndCollect("package.remove", "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(results)).To(Equal(2))
+
+			m.Register()
+			m.Publish(PackageInstalled, "foo")
+			Expect(count()).To(Equal(0))
+		})
+
+		It("tears down all the listeners on close", func() {
+			m.Register()
+			Expect(m.Bus.GetListenerCount(string(PackageInstalled))).To(Equal(1))
+
+			Expect(m.Close()).To(Succeed())
+			Expect(m.Bus.GetListenerCount(string(PackageInstalled))).To(Equal(0))
+			Expect(m.Bus.GetListenerCount(string(PackageInstalled) + "-results")).To(Equal(0))
+
+			results, err := m.PublishAndCollect(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results).To(BeEmpty())
+
+			m.Register()
+			results, err = m.PublishAndCollect(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(results)).To(Equal(2))
+		})
+	})
+})
@@ -0,0 +1,186 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Manifest describes a plugin in a YAML or JSON file.
+//
+// When Name or Executable are empty, they default to the manifest
+// file name without extension, so a manifest can be placed next to
+// the executable it describes. Relative executable paths are relative
+// to the manifest directory.
+type Manifest struct {
+	Name       string            `json:"name" yaml:"name"`
+	Executable string            `json:"executable" yaml:"executable"`
+	Args       []string          `json:"args" yaml:"args"`
+	Env        map[string]string `json:"env" yaml:"env"`
+	Events     []EventType       `json:"events" yaml:"events"`
+	Timeout    string            `json:"timeout" yaml:"timeout"`
+	Priority   int               `json:"priority" yaml:"priority"`
+	Persistent bool              `json:"persistent" yaml:"persistent"`
+	Protocol   Protocol          `json:"protocol" yaml:"protocol"`
+	Encoding   string            `json:"encoding" yaml:"encoding"`
+	Transport  Transport         `json:"transport" yaml:"transport"`
+	Enabled    *bool             `json:"enabled" yaml:"enabled"`
+}
+
+var manifestExtensions = []string{".yaml", ".yml", ".json"}
+
+func isManifest(path string) bool {
+	ext := filepath.Ext(path)
+	for _, e := range manifestExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadManifest reads a manifest file
+func ReadManifest(path string) (*Manifest, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	if filepath.Ext(path) == ".json" {
+		d := json.NewDecoder(bytes.NewReader(dat))
+		d.DisallowUnknownFields()
+		err = d.Decode(m)
+	} else {
+		err = yaml.UnmarshalStrict(dat, m)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding manifest")
+	}
+	return m, nil
+}
+
+// IsEnabled returns false if the manifest explicitly disables the plugin
+func (m Manifest) IsEnabled() bool {
+	return m.Enabled == nil || *m.Enabled
+}
+
+// Plugin returns the plugin described by the manifest located at path
+func (m Manifest) Plugin(path string) (Plugin, error) {
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	p := Plugin{
+		Name:       m.Name,
+		Executable: m.Executable,
+		Args:       m.Args,
+		Events:     m.Events,
+		Priority:   m.Priority,
+		Persistent: m.Persistent,
+		Protocol:   m.Protocol,
+		Encoding:   m.Encoding,
+		Transport:  m.Transport,
+	}
+	if p.Name == "" {
+		p.Name = base
+	}
+	if p.Executable == "" {
+		p.Executable = base
+	}
+	if !filepath.IsAbs(p.Executable) {
+		p.Executable = filepath.Join(filepath.Dir(path), p.Executable)
+	}
+
+	switch p.Protocol {
+	case ProtocolDefault, ProtocolJSONRPC:
+	default:
+		return p, fmt.Errorf("unknown protocol %q", p.Protocol)
+	}
+	if err := validTransport(p.Transport); err != nil {
+		return p, err
+	}
+	if _, ok := CodecFor(p.Encoding); !ok {
+		return p, fmt.Errorf("unknown encoding %q", p.Encoding)
+	}
+
+	if m.Timeout != "" {
+		t, err := time.ParseDuration(m.Timeout)
+		if err != nil {
+			return p, errors.Wrap(err, "invalid timeout")
+		}
+		p.Timeout = t
+	}
+
+	for k, v := range m.Env {
+		p.Env = append(p.Env, k+"="+v)
+	}
+	sort.Strings(p.Env)
+
+	info, err := os.Stat(p.Executable)
+	if err != nil {
+		return p, errors.Wrap(err, "invalid executable")
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return p, fmt.Errorf("%s is not executable", p.Executable)
+	}
+	return p, nil
+}
+
+// LoadManifests loads the plugins described by the manifest files (.yaml, .yml or .json) in dir.
+// Disabled plugins are skipped. Invalid manifests, or manifests conflicting with
+// plugins already loaded, are reported in the returned error, while valid ones are loaded.
+// Plugins loaded after Register are subscribed right away.
+func (m *Manager) LoadManifests(dir string) (*Manager, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return m, errors.Wrap(err, "while reading manifests directory")
+	}
+
+	var errs MultiError
+	for _, entry := range entries {
+		if entry.IsDir() || !isManifest(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+
+		manifest, err := ReadManifest(path)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "manifest %s", path))
+			continue
+		}
+		if !manifest.IsEnabled() {
+			continue
+		}
+
+		p, err := manifest.Plugin(path)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "manifest %s", path))
+			continue
+		}
+		if !m.addPlugin(p) {
+			errs = append(errs, fmt.Errorf("manifest %s: plugin %s conflicts with an already loaded plugin", path, p.Name))
+		}
+	}
+	return m, errs.ErrorOrNil()
+}
@@ -0,0 +1,114 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/mudler/go-pluggable"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Manifest", func() {
+	Context("loading manifests", func() {
+		var temp string
+		var m *Manager
+
+		BeforeEach(func() {
+			var err error
+			temp, err = ioutil.TempDir(os.TempDir(), "manifests")
+			Expect(err).Should(BeNil())
+			m = NewManager([]EventType{PackageInstalled})
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(temp)
+		})
+
+		It("loads plugins from manifests", func() {
+			writePlugin(temp, "foo", `echo "{ \"state\": \"$2 $FOO\" }"`)
+			Expect(ioutil.WriteFile(filepath.Join(temp, "foo.yaml"), []byte(`
+args: ["hello"]
+env:
+  FOO: bar
+timeout: 10s
+`), 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(temp, "second.json"), []byte(`
+{ "name": "second", "executable": "foo", "priority": 10, "events": ["package.remove"] }
+`), 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(temp, "third.yml"), []byte(`
+name: third
+executable: foo
+enabled: false
+`), 0600)).To(Succeed())
+
+			_, err := m.LoadManifests(temp)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("second.json"))
+
+			Expect(len(m.Plugins)).To(Equal(1))
+			Expect(m.Plugins[0].Name).To(Equal("foo"))
+			Expect(m.Plugins[0].Executable).To(Equal(filepath.Join(temp, "foo")))
+			Expect(m.Plugins[0].Timeout).To(Equal(10 * time.Second))
+
+			m.Register()
+			results, err := m.PublishAndCollect(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results[0].Response.State).To(Equal("hello bar"))
+		})
+
+		It("subscribes plugins loaded after Register", func() {
+			writePlugin(temp, "foo", `echo '{ "state": "ok" }'`)
+			Expect(ioutil.WriteFile(filepath.Join(temp, "foo.yaml"), []byte("timeout: 10s\n"), 0600)).To(Succeed())
+
+			m.Register()
+			_, err := m.LoadManifests(temp)
+			Expect(err).ToNot(HaveOccurred())
+
+			results, err := m.PublishAndCollect(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(results)).To(Equal(1))
+			Expect(results[0].Response.State).To(Equal("ok"))
+		})
+
+		It("reports invalid manifests", func() {
+			Expect(ioutil.WriteFile(filepath.Join(temp, "foo.yaml"), []byte(`
+timeout: never
+`), 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(temp, "bar.yaml"), []byte(`
+unknown: field
+`), 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(temp, "baz.yaml"), []byte(`
+executable: /does/not/exist
+`), 0600)).To(Succeed())
+			writePlugin(temp, "qux", "")
+			Expect(ioutil.WriteFile(filepath.Join(temp, "qux.json"), []byte(`
+{ "timout": "10s" }
+`), 0600)).To(Succeed())
+
+			_, err := m.LoadManifests(temp)
+			Expect(err).To(HaveOccurred())
+			errs, ok := err.(MultiError)
+			Expect(ok).To(BeTrue())
+			Expect(len(errs)).To(Equal(4))
+			Expect(err.Error()).To(ContainSubstring(`unknown field "timout"`))
+			Expect(m.Plugins).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,119 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import "strings"
+
+// Event names are made of segments separated by dots, like "package.install".
+// Event patterns can be used in place of event names to subscribe to several
+// events at once, with wildcards in place of whole segments:
+//
+//   - "*" matches exactly one segment: "package.*" matches "package.install"
+//     but neither "package" nor "package.install.pre"
+//   - "**" matches one or more segments: "package.**" matches "package.install"
+//     and "package.install.pre", but not "package"
+//
+// Wildcards only match whole segments, "package.inst*" matches only itself.
+// Names without wildcards match only themselves, as before patterns existed.
+
+const (
+	wildcardOne = "*"
+	wildcardAny = "**"
+)
+
+// IsPattern returns true if the event type contains wildcards
+func (e EventType) IsPattern() bool {
+	for _, s := range strings.Split(string(e), ".") {
+		if s == wildcardOne || s == wildcardAny {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches returns true if the event type matches the pattern, see IsPattern
+func (e EventType) Matches(pattern EventType) bool {
+	if e == pattern {
+		return true
+	}
+	if !pattern.IsPattern() {
+		return false
+	}
+	return matchSegments(strings.Split(string(pattern), "."), strings.Split(string(e), "."))
+}
+
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	switch pattern[0] {
+	case wildcardAny:
+		for i := 1; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	case wildcardOne:
+		return len(name) > 0 && matchSegments(pattern[1:], name[1:])
+	default:
+		return len(name) > 0 && pattern[0] == name[0] && matchSegments(pattern[1:], name[1:])
+	}
+}
+
+// emit publishes the event on the Manager bus, binding it first if the bus
+// is subscribed and the event is matched by patterns of the Manager events
+func (m *Manager) emit(ev *Event) {
+	m.mu.Lock()
+	if _, subscribed := m.dispatchers[m.Bus]; subscribed {
+		for _, e := range m.Events {
+			if e.IsPattern() && ev.Name.Matches(e) {
+				m.bind(m.Bus, ev.Name)
+				break
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	m.Bus.Emit(string(ev.Name), ev)
+}
+
+// emitResults delivers the response to the Response listeners of the event,
+// and of the patterns matching it
+func (m *Manager) emitResults(e *Event, p *Plugin, r *EventResponse) {
+	m.Bus.Emit(string(e.ResponseEventName("results")), p, r)
+
+	m.mu.Lock()
+	var patterns []EventType
+	for _, pattern := range m.responsePatterns {
+		if e.Name.Matches(pattern) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, pattern := range patterns {
+		m.Bus.Emit(string(Event{Name: pattern}.ResponseEventName("results")), p, r)
+	}
+}
+
+// routed returns true if the event is matched by any of the Manager events
+func (m *Manager) routed(event EventType) bool {
+	for _, e := range m.Events {
+		if event.Matches(e) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,204 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable_test
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/chuckpreslar/emission"
+	. "github.com/mudler/go-pluggable"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Event patterns", func() {
+	DescribeTable("matching event names",
+		func(event, pattern EventType, matches bool) {
+			Expect(event.Matches(pattern)).To(Equal(matches))
+		},
+		Entry("exact name", EventType("package.install"), EventType("package.install"), true),
+		Entry("different name", EventType("package.install"), EventType("package.remove"), false),
+		Entry("name prefix", EventType("package.install"), EventType("package"), false),
+		Entry("undotted name", EventType("package.install"), EventType("package.install.pre"), false),
+		Entry("single segment", EventType("package.install"), EventType("package.*"), true),
+		Entry("single segment, nested", EventType("package.install.pre"), EventType("package.*"), false),
+		Entry("single segment, parent", EventType("package"), EventType("package.*"), false),
+		Entry("single segment, middle", EventType("package.install.pre"), EventType("package.*.pre"), true),
+		Entry("any segments", EventType("package.install"), EventType("package.**"), true),
+		Entry("any segments, nested", EventType("package.install.pre"), EventType("package.**"), true),
+		Entry("any segments, parent", EventType("package"), EventType("package.**"), false),
+		Entry("any segments, middle", EventType("package.install.pre"), EventType("**.pre"), true),
+		Entry("all events", EventType("repository.update"), EventType("**"), true),
+		Entry("partial segment", EventType("package.install"), EventType("package.inst*"), false),
+		Entry("other prefix", EventType("repository.update"), EventType("package.**"), false),
+	)
+
+	It("tells patterns apart from names", func() {
+		Expect(EventType("package.*").IsPattern()).To(BeTrue())
+		Expect(EventType("**").IsPattern()).To(BeTrue())
+		Expect(EventType("package.install").IsPattern()).To(BeFalse())
+		Expect(EventType("package.inst*").IsPattern()).To(BeFalse())
+	})
+
+	Context("subscriptions", func() {
+		var temp string
+
+		plugin := func(name string, events ...EventType) Plugin {
+			path := writePlugin(temp, name, `jq -c '{state: "ok", data: (.name | tojson)}' <&0`)
+			return Plugin{Name: name, Executable: path, Events: events}
+		}
+
+		names := func(results []PluginResult) map[string]string {
+			res := map[string]string{}
+			for _, r := range results {
+				var name string
+				Expect(r.Response.Unmarshal(&name)).To(Succeed())
+				res[r.Plugin.Name] = name
+			}
+			return res
+		}
+
+		BeforeEach(func() {
+			var err error
+			temp, err = ioutil.TempDir("", "match")
+			Expect(err).Should(BeNil())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(temp)
+		})
+
+		It("runs plugins subscribed to patterns with the concrete event name", func() {
+			m := NewManager([]EventType{"package.install", "package.remove", "package.install.pre"})
+			defer m.Close()
+			m.Plugins = []Plugin{
+				plugin("exact", "package.install"),
+				plugin("one", "package.*"),
+				plugin("any", "package.**"),
+			}
+			m.Register()
+
+			results, err := m.PublishAndCollect("package.install", nil)
+			Expect(err).Should(BeNil())
+			Expect(names(results)).To(Equal(map[string]string{
+				"exact": "package.install",
+				"one":   "package.install",
+				"any":   "package.install",
+			}))
+
+			results, err = m.PublishAndCollect("package.install.pre", nil)
+			Expect(err).Should(BeNil())
+			Expect(names(results)).To(Equal(map[string]string{"any": "package.install.pre"}))
+
+			results, err = m.PublishAndCollect("package.remove", nil)
+			Expect(err).Should(BeNil())
+			Expect(names(results)).To(Equal(map[string]string{
+				"one": "package.remove",
+				"any": "package.remove",
+			}))
+		})
+
+		It("dispatches events matching the Manager event patterns", func() {
+			m := NewManager([]EventType{"package.**"})
+			defer m.Close()
+			m.Plugins = []Plugin{plugin("all"), plugin("some", "package.install")}
+			m.Register()
+
+			results, err := m.PublishAndCollect("package.install", nil)
+			Expect(err).Should(BeNil())
+			Expect(names(results)).To(Equal(map[string]string{
+				"all":  "package.install",
+				"some": "package.install",
+			}))
+
+			results, err = m.PublishAndCollect("package.remove.post", nil)
+			Expect(err).Should(BeNil())
+			Expect(names(results)).To(Equal(map[string]string{"all": "package.remove.post"}))
+
+			results, err = m.PublishAndCollect("repository.update", nil)
+			Expect(err).Should(BeNil())
+			Expect(results).To(BeEmpty())
+
+			m.Unsubscribe("package.**")
+			results, err = m.PublishAndCollect("package.install", nil)
+			Expect(err).Should(BeNil())
+			Expect(results).To(BeEmpty())
+		})
+
+		It("binds event patterns only on the Manager bus, as they are published", func() {
+			m := NewManager([]EventType{"package.*"})
+			defer m.Close()
+			m.Plugins = []Plugin{plugin("a")}
+			m.Register()
+			other := emission.NewEmitter()
+			Expect(func() { m.Subscribe(other) }).To(PanicWith(MatchError(ContainSubstring("package.*"))))
+
+			var mu sync.Mutex
+			responses := 0
+			m.Response("package.*", func(p *Plugin, r *EventResponse) {
+				mu.Lock()
+				defer mu.Unlock()
+				responses++
+			})
+
+			ev, err := NewEvent("package.install", nil)
+			Expect(err).Should(BeNil())
+			m.Bus.Emit("package.install", ev)
+
+			results, err := m.PublishAndCollect("package.install", nil)
+			Expect(err).Should(BeNil())
+			Expect(names(results)).To(Equal(map[string]string{"a": "package.install"}))
+			Expect(other.GetListenerCount("package.install")).To(Equal(0))
+			Expect(m.Bus.GetListenerCount("package.install")).To(Equal(1))
+
+			mu.Lock()
+			defer mu.Unlock()
+			Expect(responses).To(Equal(1))
+		})
+
+		It("delivers responses to listeners of matching patterns", func() {
+			m := NewManager([]EventType{"package.install", "package.remove"})
+			defer m.Close()
+			m.Plugins = []Plugin{plugin("a")}
+
+			var mu sync.Mutex
+			var exact, any []EventType
+			m.Response("package.install", func(p *Plugin, r *EventResponse) {
+				mu.Lock()
+				defer mu.Unlock()
+				exact = append(exact, r.Event)
+			})
+			m.Response("package.*", func(p *Plugin, r *EventResponse) {
+				mu.Lock()
+				defer mu.Unlock()
+				any = append(any, r.Event)
+			})
+			m.Register()
+
+			_, err := m.Publish("package.install", nil)
+			Expect(err).Should(BeNil())
+			_, err = m.Publish("package.remove", nil)
+			Expect(err).Should(BeNil())
+
+			mu.Lock()
+			defer mu.Unlock()
+			Expect(exact).To(Equal([]EventType{"package.install"}))
+			Expect(any).To(ConsistOf(EventType("package.install"), EventType("package.remove")))
+		})
+	})
+})
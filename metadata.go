@@ -0,0 +1,83 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+// EventMetadata describes an event, so its responses and the events
+// it causes can be traced back to it. Plugins are free to ignore it.
+type EventMetadata struct {
+	// ID uniquely identifies the event
+	ID        string    `json:"id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+
+	// CorrelationID is shared by all the events originating from the same one
+	CorrelationID string `json:"correlationId,omitempty"`
+	// CausationID is the ID of the event which caused this one, if any
+	CausationID string `json:"causationId,omitempty"`
+
+	// Source identifies the publisher of the event
+	Source  string            `json:"source,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// NewEventMetadata returns metadata with a new ID, correlated to itself
+func NewEventMetadata() *EventMetadata {
+	id := newEventID()
+	return &EventMetadata{ID: id, Timestamp: time.Now().UTC(), CorrelationID: id}
+}
+
+// Caused returns new metadata for an event caused by the one described by md,
+// which shares its correlation ID and headers
+func (md EventMetadata) Caused() *EventMetadata {
+	n := NewEventMetadata()
+	n.CausationID = md.ID
+	if md.CorrelationID != "" {
+		n.CorrelationID = md.CorrelationID
+	}
+	n.Source = md.Source
+	if len(md.Headers) > 0 {
+		n.Headers = make(map[string]string, len(md.Headers))
+		for k, v := range md.Headers {
+			n.Headers[k] = v
+		}
+	}
+	return n
+}
+
+// newEventID returns a random (version 4) UUID
+func newEventID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// event returns a new event from the Manager, see NewEvent.
+// The event is validated against its schema, if any.
+func (m *Manager) event(name EventType, obj interface{}) (*Event, error) {
+	ev, err := NewEvent(name, obj)
+	if err != nil {
+		return ev, err
+	}
+	ev.Metadata.Source = m.Source
+	return ev, m.validateEvent(ev)
+}
@@ -0,0 +1,165 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/mudler/go-pluggable"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Event metadata", func() {
+	It("is populated by NewEvent", func() {
+		e, err := NewEvent(PackageInstalled, "foo")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Metadata).ToNot(BeNil())
+		Expect(e.Metadata.ID).ToNot(BeEmpty())
+		Expect(e.Metadata.CorrelationID).To(Equal(e.Metadata.ID))
+		Expect(e.Metadata.Timestamp.IsZero()).To(BeFalse())
+
+		e2, err := NewEvent(PackageInstalled, "foo")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e2.Metadata.ID).ToNot(Equal(e.Metadata.ID))
+	})
+
+	It("correlates caused events", func() {
+		e, err := NewEvent(PackageInstalled, "foo")
+		Expect(err).ToNot(HaveOccurred())
+		e.Metadata.Headers = map[string]string{"user": "foo"}
+
+		md := e.Metadata.Caused()
+		Expect(md.ID).ToNot(Equal(e.Metadata.ID))
+		Expect(md.CausationID).To(Equal(e.Metadata.ID))
+		Expect(md.CorrelationID).To(Equal(e.Metadata.CorrelationID))
+		Expect(md.Headers).To(Equal(map[string]string{"user": "foo"}))
+	})
+
+	It("is echoed by the factory", func() {
+		e, err := NewEvent("foo", "bar")
+		Expect(err).ToNot(HaveOccurred())
+		dat, err := json.Marshal(e)
+		Expect(err).ToNot(HaveOccurred())
+
+		factory := NewPluginFactory()
+		factory.Add("foo", func(e *Event) EventResponse { return EventResponse{State: "ok"} })
+		b := bytes.NewBufferString("")
+		Expect(factory.Run("foo", bytes.NewBuffer(dat), b)).To(Succeed())
+
+		resp := &EventResponse{}
+		Expect(json.Unmarshal(b.Bytes(), resp)).To(Succeed())
+		Expect(resp.Metadata).To(Equal(e.Metadata))
+	})
+
+	Context("publishing events", func() {
+		var temp string
+		var m *Manager
+
+		BeforeEach(func() {
+			var err error
+			temp, err = ioutil.TempDir("", "metadata")
+			Expect(err).Should(BeNil())
+
+			// The plugin responds with the metadata it received
+			aware := writePlugin(temp, "aware", `jq -c '{state: .metadata.correlationId, data: (.metadata | tojson)}' <&0`)
+			legacy := writePlugin(temp, "legacy", `echo '{ "state": "ok" }'`)
+
+			m = NewManager([]EventType{PackageInstalled})
+			m.Source = "tests"
+			m.Plugins = []Plugin{
+				{Name: "aware", Executable: aware},
+				{Name: "legacy", Executable: legacy},
+			}
+			m.Register()
+		})
+
+		AfterEach(func() {
+			m.Close()
+			os.RemoveAll(temp)
+		})
+
+		It("sends the metadata to the plugins and echoes it in the responses", func() {
+			var responses []*EventResponse
+			m.Response(PackageInstalled, func(p *Plugin, r *EventResponse) {
+				if p.Name == "aware" {
+					responses = append(responses, r)
+				}
+			})
+
+			e, err := NewEvent(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			e.Metadata.CorrelationID = "abc"
+			e.Metadata.Headers = map[string]string{"user": "foo"}
+			_, err = m.PublishEvent(e)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(len(responses)).To(Equal(1))
+			Expect(responses[0].State).To(Equal("abc"))
+			md := &EventMetadata{}
+			Expect(responses[0].Unmarshal(md)).To(Succeed())
+			Expect(md.ID).To(Equal(e.Metadata.ID))
+			Expect(md.Source).To(Equal("tests"))
+			Expect(md.Headers).To(Equal(map[string]string{"user": "foo"}))
+			Expect(e.Metadata.Source).To(BeEmpty())
+		})
+
+		It("sends the metadata to JSON-RPC plugins", func() {
+			captured := filepath.Join(temp, "request")
+			m.Plugins = []Plugin{{
+				Name:       "rpc",
+				Executable: writePlugin(temp, "rpc", `tee "`+captured+`" | jq -c '{jsonrpc: "2.0", id: .id, result: {}}'`),
+				Protocol:   ProtocolJSONRPC,
+			}}
+			m.Register()
+
+			e, err := NewEvent(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			e.Metadata.Headers = map[string]string{"user": "foo"}
+			_, err = m.PublishEvent(e)
+			Expect(err).ToNot(HaveOccurred())
+
+			var received *Event
+			factory := NewPluginFactory()
+			factory.Add(PackageInstalled, func(e *Event) EventResponse {
+				received = e
+				return EventResponse{}
+			})
+			req, err := os.Open(captured)
+			Expect(err).ToNot(HaveOccurred())
+			defer req.Close()
+			Expect(factory.Run(PackageInstalled, req, ioutil.Discard)).To(Succeed())
+
+			Expect(received).ToNot(BeNil())
+			Expect(received.Metadata).ToNot(BeNil())
+			Expect(received.Metadata.ID).To(Equal(e.Metadata.ID))
+			Expect(received.Metadata.Source).To(Equal("tests"))
+			Expect(received.Metadata.Headers).To(Equal(map[string]string{"user": "foo"}))
+		})
+
+		It("fills in the responses of plugins ignoring it", func() {
+			results, err := m.PublishAndCollect(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results[1].Response.State).To(Equal("ok"))
+			Expect(results[1].Response.Metadata).ToNot(BeNil())
+			Expect(results[1].Response.Metadata.ID).To(Equal(results[0].Response.Metadata.ID))
+			Expect(results[1].Response.Metadata.Source).To(Equal("tests"))
+		})
+	})
+})
@@ -0,0 +1,65 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Recovery is a middleware turning panics of the handler into a response with
+// StatePanic, with the stack trace in the logs. The factory always recovers
+// panics, Recovery lets the middleware running before it see the response.
+func Recovery(h PluginHandler) PluginHandler {
+	return func(e *Event) EventResponse {
+		return recovered(h, e)
+	}
+}
+
+// Timing is a middleware logging how long the handler took, at the debug level
+func Timing(h PluginHandler) PluginHandler {
+	return func(e *Event) EventResponse {
+		start := time.Now()
+		resp := h(e)
+		e.Logger().Debugf("%s handled in %s", e.Name, time.Since(start))
+		return resp
+	}
+}
+
+type decodedKey struct{}
+
+// Decode returns a middleware decoding the event payload in a T, which the
+// handler gets with Decoded. Events whose payload can't be decoded get a
+// response with the error, without running the handler.
+func Decode[T any]() Middleware {
+	return func(h PluginHandler) PluginHandler {
+		return func(e *Event) EventResponse {
+			var v T
+			if e.Data != "" || len(e.Payload) > 0 {
+				if err := e.Unmarshal(&v); err != nil {
+					return EventResponse{Error: errors.Wrap(err, "while decoding event data").Error()}
+				}
+			}
+			return h(e.WithContext(context.WithValue(e.Context(), decodedKey{}, v)))
+		}
+	}
+}
+
+// Decoded returns the payload decoded by the Decode middleware
+func Decoded[T any](e *Event) (T, bool) {
+	v, ok := e.Context().Value(decodedKey{}).(T)
+	return v, ok
+}
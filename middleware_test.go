@@ -0,0 +1,107 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	. "github.com/mudler/go-pluggable"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Middleware", func() {
+	var factory *Factory
+
+	run := func(name EventType, obj interface{}) EventResponse {
+		e, err := NewEvent(name, obj)
+		Expect(err).ToNot(HaveOccurred())
+		dat, err := json.Marshal(e)
+		Expect(err).ToNot(HaveOccurred())
+
+		b := bytes.NewBufferString("")
+		Expect(factory.Run(name, bytes.NewBuffer(dat), b)).To(Succeed())
+		resp := EventResponse{}
+		Expect(json.Unmarshal(b.Bytes(), &resp)).To(Succeed())
+		return resp
+	}
+
+	// tag is a middleware appending its name to the response state
+	tag := func(name string) Middleware {
+		return func(h PluginHandler) PluginHandler {
+			return func(e *Event) EventResponse {
+				e.Logger().Info("before " + name)
+				resp := h(e)
+				resp.State += name
+				return resp
+			}
+		}
+	}
+
+	BeforeEach(func() {
+		factory = NewFactory(FactoryPlugin{
+			EventType:     "foo",
+			PluginHandler: func(e *Event) EventResponse { return EventResponse{State: "h"} },
+		})
+	})
+
+	It("wraps the handlers globally and per event", func() {
+		factory.Use(tag("a"), tag("b"))
+		factory.UseFor("foo", tag("c"))
+		factory.Add("bar", func(e *Event) EventResponse { return EventResponse{State: "h"} })
+
+		resp := run("foo", nil)
+		Expect(resp.State).To(Equal("hcba"))
+		Expect(resp.Logs).To(Equal("info: before a\ninfo: before b\ninfo: before c\n"))
+
+		Expect(run("bar", nil).State).To(Equal("hba"))
+	})
+
+	It("decodes payloads", func() {
+		factory.Add("bar", func(e *Event) EventResponse {
+			v, ok := Decoded[map[string]string](e)
+			Expect(ok).To(BeTrue())
+			return EventResponse{State: v["foo"]}
+		})
+		factory.UseFor("bar", Decode[map[string]string]())
+
+		Expect(run("bar", map[string]string{"foo": "baz"}).State).To(Equal("baz"))
+
+		resp := run("bar", []int{1})
+		Expect(resp.State).To(BeEmpty())
+		Expect(resp.Error).To(ContainSubstring("while decoding event data"))
+	})
+
+	It("times the handlers", func() {
+		factory.Use(Timing)
+
+		resp := run("foo", nil)
+		Expect(resp.State).To(Equal("h"))
+		Expect(len(resp.Entries)).To(Equal(1))
+		Expect(resp.Entries[0].Level).To(Equal(LogDebug))
+		Expect(strings.HasPrefix(resp.Entries[0].Message, "foo handled in")).To(BeTrue())
+	})
+
+	It("recovers panics inside the middleware", func() {
+		factory.Add("foo", func(e *Event) EventResponse { panic("boom") })
+		factory.Use(tag("a"), Recovery)
+
+		resp := run("foo", nil)
+		Expect(resp.State).To(Equal(StatePanic + "a"))
+		Expect(resp.Error).To(Equal("panic: boom"))
+	})
+})
@@ -0,0 +1,101 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// DispatchMode describes how an event is dispatched to the plugins subscribed to it
+type DispatchMode string
+
+const (
+	// DispatchConcurrent runs all the plugins independently, in parallel.
+	// Publish returns once all of them completed, see PublishAsync otherwise.
+	DispatchConcurrent DispatchMode = ""
+	// DispatchPipeline runs the plugins one after the other by Priority, higher first.
+	// When a plugin responds with data, the data replaces the event payload passed
+	// to the next plugin. The pipeline stops at the first plugin which fails or
+	// responds with StateHalt. Plugins responding with StateUnhandled are skipped.
+	DispatchPipeline DispatchMode = "pipeline"
+)
+
+// StateHalt is the state plugins respond with to stop a pipeline
+const StateHalt = "halt"
+
+// pipeline runs the plugins sequentially, as described by DispatchPipeline
+func (m *Manager) pipeline(e *Event, plugins []Plugin) {
+	sort.SliceStable(plugins, func(i, j int) bool {
+		return plugins[i].Priority > plugins[j].Priority
+	})
+
+	current := e
+	final := EventResponse{Data: e.Data}
+	for _, p := range plugins {
+		resp, ok := m.propagateEvent(p, current)
+		if !ok || resp.Unhandled() {
+			continue
+		}
+		final = resp
+		if final.Errored() || final.State == StateHalt {
+			break
+		}
+		if final.HasData() {
+			next := current.Copy()
+			next.Data, next.Payload, next.Encoding = final.Data, final.Payload, final.Encoding
+			next.File = ""
+			current = next
+		}
+	}
+	if !final.HasData() {
+		final.Data, final.Payload, final.Encoding = current.Data, current.Payload, current.Encoding
+	}
+
+	if e.results != nil {
+		e.results.Lock()
+		e.results.final = final
+		e.results.Unlock()
+	}
+}
+
+// PublishPipeline publishes the event running the subscribed plugins as a pipeline,
+// regardless of the Manager Dispatch mode (see DispatchPipeline).
+// It returns the response of the last plugin run, carrying the payload resulting
+// from the pipeline, and the error of the plugin which stopped the pipeline, if any.
+// Listeners bound with Response are called for each plugin.
+func (m *Manager) PublishPipeline(event EventType, obj interface{}) (EventResponse, error) {
+	ev, err := m.event(event, obj)
+	if err != nil {
+		return EventResponse{}, err
+	}
+	c := &collector{pipeline: true}
+	ev.results = c
+	m.emit(ev)
+
+	c.Lock()
+	defer c.Unlock()
+	for i := len(c.results) - 1; i >= 0; i-- {
+		last := c.results[i]
+		if last.Response.Unhandled() {
+			continue
+		}
+		if last.Error != nil {
+			return c.final, errors.Wrapf(last.Error, "plugin %s", last.Plugin.Name)
+		}
+		return c.final, nil
+	}
+	return EventResponse{Data: ev.Data}, nil
+}
@@ -0,0 +1,125 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "github.com/mudler/go-pluggable"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Pipeline", func() {
+	Context("running plugins in order", func() {
+		var temp string
+		var m *Manager
+
+		// step writes a plugin appending its name to the "steps" field of the payload
+		step := func(name, state string) string {
+			return writePlugin(temp, name, `jq -c --arg name "`+name+`" --arg state "`+state+`" \
+	'{state: $state, data: (.data | fromjson | .steps += $name | tojson)}' <&0`)
+		}
+
+		BeforeEach(func() {
+			var err error
+			temp, err = ioutil.TempDir(os.TempDir(), "pipeline")
+			Expect(err).Should(BeNil())
+			m = NewManager([]EventType{PackageInstalled})
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(temp)
+		})
+
+		It("passes the data along by priority", func() {
+			m.Plugins = []Plugin{
+				{Name: "c", Executable: step("c", ""), Priority: 1},
+				{Name: "a", Executable: step("a", ""), Priority: 10},
+				{Name: "b", Executable: step("b", ""), Priority: 5},
+			}
+			m.Register()
+
+			var order []string
+			m.Response(PackageInstalled, func(p *Plugin, r *EventResponse) {
+				order = append(order, p.Name)
+			})
+
+			resp, err := m.PublishPipeline(PackageInstalled, map[string]string{"steps": ""})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(order).To(Equal([]string{"a", "b", "c"}))
+
+			res := map[string]string{}
+			Expect(resp.Unmarshal(&res)).To(Succeed())
+			Expect(res["steps"]).To(Equal("abc"))
+		})
+
+		It("skips plugins which don't handle the event", func() {
+			m.Plugins = []Plugin{
+				{Name: "a", Executable: step("a", ""), Priority: 10},
+				{Name: "b", Executable: writePlugin(temp, "b", `echo '{ "state": "unhandled", "error": "unhandled event package.install" }'`), Priority: 5},
+				{Name: "c", Executable: step("c", ""), Priority: 1},
+				{Name: "d", Executable: writePlugin(temp, "d", `echo '{ "state": "unhandled", "error": "unhandled event package.install" }'`), Priority: 0},
+			}
+			m.Register()
+
+			resp, err := m.PublishPipeline(PackageInstalled, map[string]string{"steps": ""})
+			Expect(err).ToNot(HaveOccurred())
+			res := map[string]string{}
+			Expect(resp.Unmarshal(&res)).To(Succeed())
+			Expect(res["steps"]).To(Equal("ac"))
+		})
+
+		It("stops when a plugin halts", func() {
+			m.Plugins = []Plugin{
+				{Name: "a", Executable: step("a", ""), Priority: 10},
+				{Name: "b", Executable: step("b", StateHalt), Priority: 5},
+				{Name: "c", Executable: step("c", ""), Priority: 1},
+			}
+			m.Dispatch = DispatchPipeline
+			m.Register()
+
+			results, err := m.PublishAndCollect(PackageInstalled, map[string]string{"steps": ""})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(results)).To(Equal(2))
+
+			resp, err := m.PublishPipeline(PackageInstalled, map[string]string{"steps": ""})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.State).To(Equal(StateHalt))
+			res := map[string]string{}
+			Expect(resp.Unmarshal(&res)).To(Succeed())
+			Expect(res["steps"]).To(Equal("ab"))
+		})
+
+		It("stops when a plugin fails", func() {
+			failing := writePlugin(temp, "failing", "exit 1")
+			m.Plugins = []Plugin{
+				{Name: "a", Executable: step("a", ""), Priority: 10},
+				{Name: "failing", Executable: failing, Priority: 5},
+				{Name: "c", Executable: step("c", ""), Priority: 1},
+			}
+			m.Register()
+
+			resp, err := m.PublishPipeline(PackageInstalled, map[string]string{"steps": ""})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("plugin failing"))
+			Expect(resp.Errored()).To(BeTrue())
+			res := map[string]string{}
+			Expect(resp.Unmarshal(&res)).To(Succeed())
+			Expect(res["steps"]).To(Equal("a"))
+		})
+	})
+})
@@ -15,10 +15,11 @@ package pluggable
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"io/ioutil"
 	"os"
 	"os/exec"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -27,47 +28,233 @@ import (
 type Plugin struct {
 	Name       string
 	Executable string
+
+	// Timeout bounds a single plugin execution. When zero, the Manager
+	// default is used, if any.
+	Timeout time.Duration
+
+	// Persistent plugins are started once by the Manager and receive events
+	// over stdin, instead of being executed for each event. See EventServe.
+	Persistent bool
+
+	// Protocol is the wire format used to talk with the plugin
+	Protocol Protocol
+
+	// Transport is the way payloads are passed to the plugin. It is
+	// ignored by Persistent and JSON-RPC plugins, which get them inline.
+	Transport Transport
+
+	// Encoding is the codec of the payloads sent to the plugin, JSON when empty.
+	// It is negotiated during the handshake, unless set. JSON-RPC plugins always get JSON.
+	Encoding string
+
+	// Events restricts the events the plugin is subscribed to.
+	// When empty, the plugin is subscribed to all the Manager events.
+	Events []EventType
+
+	// Description is the plugin answer to the handshake, if any
+	Description *PluginDescription
+
+	// Args are passed to the executable after the event name
+	Args []string
+	// Env are additional environment variables, in the form "key=value"
+	Env []string
+
+	// Priority orders the plugin relative to the others, higher values first
+	Priority int
+
+	// Retry is the retry policy of the plugin. When nil, the Manager one is used, if any.
+	Retry *RetryPolicy
+}
+
+// id identifies the plugin within a Manager
+func (p Plugin) id() string {
+	return p.Name + ":" + p.Executable
+}
+
+// Handles returns true if the plugin is subscribed to the given event
+func (p Plugin) Handles(e EventType) bool {
+	if len(p.Events) == 0 {
+		return true
+	}
+	for _, ev := range p.Events {
+		if e.Matches(ev) {
+			return true
+		}
+	}
+	return false
 }
 
+// ErrPluginTimeout is returned when a plugin doesn't complete before its deadline
+var ErrPluginTimeout = errors.New("plugin execution timed out")
+
 // A safe threshold to avoid unpleasant exec buffer fill for argv too big. Seems 128K is the limit on Linux.
 const maxMessageSize = 1 << 13
 
 // Run runs the Event on the plugin, and returns an EventResponse
 func (p Plugin) Run(e Event) (EventResponse, error) {
+	return p.RunContext(e.Context(), e)
+}
+
+// RunContext runs the Event on the plugin and returns an EventResponse.
+// The plugin process (and every process it spawned) is killed when the context
+// is done or the plugin Timeout expires.
+func (p Plugin) RunContext(ctx context.Context, e Event) (EventResponse, error) {
 	r := EventResponse{}
 
-	eventToprocess := &e
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	req, err := p.request(e)
+	if err != nil {
+		return r, err
+	}
+	defer req.cleanup()
+
+	cmd := p.command(string(e.Name))
+	cmd.Stdin = bytes.NewBuffer(req.stdin)
+	var b, out bytes.Buffer
+	cmd.Stderr = &b
+	cmd.Stdout = &out
+	setProcessGroup(cmd)
 
-	if len(e.Data) > maxMessageSize {
-		copy := e.Copy()
-		copy.Data = ""
-		f, err := ioutil.TempFile(os.TempDir(), "pluggable")
+	var rfd, wfd *os.File
+	if req.fd != nil {
+		rfd, wfd, err = os.Pipe()
 		if err != nil {
-			return r, errors.Wrap(err, "while creating temporary file")
-		}
-		if err := ioutil.WriteFile(f.Name(), []byte(e.Data), os.ModePerm); err != nil {
-			return r, errors.Wrap(err, "while writing to temporary file")
+			return r, errors.Wrap(err, "while creating payload pipe")
 		}
-		copy.File = f.Name()
-		eventToprocess = copy
-		defer os.RemoveAll(f.Name())
+		// ExtraFiles start at file descriptor 3, see PayloadFD
+		cmd.ExtraFiles = []*os.File{rfd}
 	}
 
-	k, err := eventToprocess.JSON()
+	err = cmd.Start()
+	if rfd != nil {
+		rfd.Close()
+		if err != nil {
+			wfd.Close()
+		} else {
+			// The write fails once the plugin exits, if it doesn't read the payload
+			go func() {
+				wfd.Write(req.fd)
+				wfd.Close()
+			}()
+		}
+	}
 	if err != nil {
-		return r, errors.Wrap(err, "while marshalling event")
+		r.Error = "error while executing plugin: " + err.Error()
+		return r, errors.Wrap(err, "while executing plugin")
 	}
-	cmd := exec.Command(p.Executable, string(e.Name))
-	cmd.Stdin = bytes.NewBuffer([]byte(k))
-	cmd.Env = os.Environ()
-	var b bytes.Buffer
-	cmd.Stderr = &b
-	out, err := cmd.Output()
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		err = ctx.Err()
+		if err == context.DeadlineExceeded {
+			err = ErrPluginTimeout
+			r.State = StateTimeout
+		}
+		r.Error = "error while executing plugin: " + err.Error()
+		return r, errors.Wrap(err, "while executing plugin")
+	}
+
 	if err != nil {
 		r.Error = "error while executing plugin: " + err.Error() + string(b.String())
 		return r, errors.Wrap(err, "while executing plugin: "+string(b.String()))
 	}
 
+	return p.response(out.Bytes())
+}
+
+// command returns the command to run the plugin with the given first argument
+func (p Plugin) command(arg string) *exec.Cmd {
+	cmd := exec.Command(p.Executable, append([]string{arg}, p.Args...)...)
+	cmd.Env = append(os.Environ(), p.Env...)
+	return cmd
+}
+
+// encoding returns the codec of the payloads sent to the plugin
+func (p Plugin) encoding() string {
+	if p.Protocol == ProtocolJSONRPC {
+		return ""
+	}
+	return p.Encoding
+}
+
+// request is what is written to a plugin to run an event
+type request struct {
+	stdin []byte
+	// fd is the payload written to PayloadFD, if any
+	fd []byte
+	// cleanup releases any resource associated with the request
+	cleanup func()
+}
+
+// request encodes the event to be written to the plugin in the plugin Protocol and Transport
+func (p Plugin) request(e Event) (request, error) {
+	req := request{cleanup: func() {}}
+	e, err := e.encoded(p.encoding())
+	if err != nil {
+		return req, err
+	}
+
+	if p.Protocol == ProtocolJSONRPC {
+		req.stdin, err = json.Marshal(newRPCRequest(1, e))
+		return req, errors.Wrap(err, "while marshalling event")
+	}
+
+	eventToprocess := &e
+	var payload []byte
+	switch p.Transport {
+	case TransportStdin, TransportFD:
+		eventToprocess, payload = e.detached()
+		eventToprocess.Stream = p.Transport
+		eventToprocess.Size = len(payload)
+	case TransportFile:
+		if len(e.payload()) > maxMessageSize {
+			eventToprocess, payload = e.detached()
+			eventToprocess.File, req.cleanup, err = writePayloadFile(payload)
+			if err != nil {
+				return req, err
+			}
+			payload = nil
+		}
+	}
+
+	k, err := json.Marshal(eventToprocess)
+	if err != nil {
+		req.cleanup()
+		return req, errors.Wrap(err, "while marshalling event")
+	}
+	req.stdin = k
+	if p.Transport == TransportStdin {
+		req.stdin = append(append(k, '\n'), payload...)
+	} else if p.Transport == TransportFD {
+		req.fd = payload
+	}
+	return req, nil
+}
+
+// response decodes the plugin output in the plugin Protocol
+func (p Plugin) response(out []byte) (EventResponse, error) {
+	r := EventResponse{}
+	if p.Protocol == ProtocolJSONRPC {
+		rr := rpcResponse{}
+		if err := json.Unmarshal(out, &rr); err != nil {
+			r.Error = err.Error()
+			return r, errors.Wrap(err, "while unmarshalling response")
+		}
+		return rr.eventResponse()
+	}
+
 	if err := json.Unmarshal(out, &r); err != nil {
 		r.Error = err.Error()
 		return r, errors.Wrap(err, "while unmarshalling response")
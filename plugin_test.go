@@ -14,12 +14,19 @@ limitations under the License.
 package pluggable_test
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	. "github.com/mudler/go-pluggable"
@@ -41,6 +48,11 @@ var _ = Describe("Plugin", func() {
 		var err error
 		var m *Manager
 
+		// writeScript writes the plugin script at the path of the temporary file
+		writeScript := func(f *os.File, script string) {
+			writePlugin(filepath.Dir(f.Name()), filepath.Base(f.Name()), script)
+		}
+
 		BeforeEach(func() {
 			pluginFile, err = ioutil.TempFile(os.TempDir(), "tests")
 			Expect(err).Should(BeNil())
@@ -55,9 +67,7 @@ var _ = Describe("Plugin", func() {
 			temp, err := ioutil.TempDir(os.TempDir(), "autoload")
 			Expect(err).Should(BeNil())
 
-			d1 := []byte("#!/bin/bash\necho \"{ \\\"state\\\": \\\"$1\\\" }\"\n")
-			err = ioutil.WriteFile(filepath.Join(temp, "test-foo"), d1, 0550)
-			Expect(err).Should(BeNil())
+			writePlugin(temp, "test-foo", `echo "{ \"state\": \"$1\" }"`)
 
 			m.Autoload("test", temp)
 			m.Events = []EventType{PackageInstalled}
@@ -77,13 +87,55 @@ var _ = Describe("Plugin", func() {
 			Expect(resp.State).Should(Equal(string(PackageInstalled)))
 		})
 
-		It("loads plugins", func() {
+		It("reports skipped plugins", func() {
 			temp, err := ioutil.TempDir(os.TempDir(), "autoload")
 			Expect(err).Should(BeNil())
+			defer os.RemoveAll(temp)
+			temp2, err := ioutil.TempDir(os.TempDir(), "autoload")
+			Expect(err).Should(BeNil())
+			defer os.RemoveAll(temp2)
 
-			d1 := []byte("#!/bin/bash\necho \"{ \\\"state\\\": \\\"$1\\\" }\"\n")
-			err = ioutil.WriteFile(filepath.Join(temp, "test-foo"), d1, 0550)
+			script := `echo "{ \"state\": \"$1\" }"`
+			writePlugin(temp, "reporttest-foo", script)
+			Expect(os.Chmod(writePlugin(temp, "reporttest-bar", script), 0600)).To(Succeed())
+			writePlugin(temp, "reporttest-baz", script)
+			Expect(os.Symlink(filepath.Join(temp, "missing"), filepath.Join(temp, "reporttest-broken"))).To(Succeed())
+			writePlugin(temp2, "reporttest-foo", script)
+
+			m.Plugins = []Plugin{{Name: "baz", Executable: pluginFile.Name()}}
+			report := m.AutoloadWithReport("reporttest", temp, temp2, temp+"/")
+
+			Expect(report.Errors).To(BeEmpty())
+			Expect(report.Loaded).To(Equal([]Plugin{{Name: "foo", Executable: filepath.Join(temp, "reporttest-foo")}}))
+
+			reasons := map[string]SkipReason{}
+			for _, s := range report.Skipped {
+				reasons[s.Path] = s.Reason
+			}
+			Expect(reasons).To(Equal(map[string]SkipReason{
+				filepath.Join(temp, "reporttest-bar"):    SkipNotExecutable,
+				filepath.Join(temp, "reporttest-baz"):    SkipDuplicate,
+				filepath.Join(temp, "reporttest-broken"): SkipBrokenSymlink,
+				filepath.Join(temp2, "reporttest-foo"):   SkipShadowed,
+			}))
+			Expect(len(report.Skipped)).To(Equal(4))
+			Expect(len(m.Plugins)).To(Equal(2))
+
+			// Paths listed more than once are scanned once
+			path := os.Getenv("PATH")
+			defer os.Setenv("PATH", path)
+			os.Setenv("PATH", temp+":"+temp2+":"+temp)
+			report = NewManager(nil).LoadWithReport("reporttest-foo")
+			Expect(report.Loaded).To(Equal([]Plugin{{Name: "reporttest-foo", Executable: filepath.Join(temp, "reporttest-foo")}}))
+			Expect(len(report.Skipped)).To(Equal(1))
+			Expect(report.Skipped[0].Path).To(Equal(filepath.Join(temp2, "reporttest-foo")))
+		})
+
+		It("loads plugins", func() {
+			temp, err := ioutil.TempDir(os.TempDir(), "autoload")
 			Expect(err).Should(BeNil())
+
+			writePlugin(temp, "test-foo", `echo "{ \"state\": \"$1\" }"`)
 			os.Setenv("PATH", os.Getenv("PATH")+":"+temp)
 			m.Load("test-foo")
 			m.Events = []EventType{PackageInstalled}
@@ -104,9 +156,7 @@ var _ = Describe("Plugin", func() {
 		})
 
 		It("gets the json event name", func() {
-			d1 := []byte("#!/bin/bash\necho \"{ \\\"state\\\": \\\"$1\\\" }\"\n")
-			err := ioutil.WriteFile(pluginFile.Name(), d1, 0550)
-			Expect(err).Should(BeNil())
+			writeScript(pluginFile, `echo "{ \"state\": \"$1\" }"`)
 
 			m.Plugins = []Plugin{{Name: "test", Executable: pluginFile.Name()}}
 			m.Events = []EventType{PackageInstalled}
@@ -126,9 +176,7 @@ var _ = Describe("Plugin", func() {
 		})
 
 		It("gets the json event payload", func() {
-			d1 := []byte("#!/bin/bash\nless <&0\n")
-			err := ioutil.WriteFile(pluginFile.Name(), d1, 0550)
-			Expect(err).Should(BeNil())
+			writeScript(pluginFile, "less <&0")
 
 			m.Plugins = []Plugin{{Name: "test", Executable: pluginFile.Name()}}
 			m.Events = []EventType{PackageInstalled}
@@ -149,9 +197,7 @@ var _ = Describe("Plugin", func() {
 		})
 
 		It("gets the plugin", func() {
-			d1 := []byte("#!/bin/bash\nless <&0\n")
-			err := ioutil.WriteFile(pluginFile.Name(), d1, 0550)
-			Expect(err).Should(BeNil())
+			writeScript(pluginFile, "less <&0")
 
 			m.Plugins = []Plugin{{Name: "test", Executable: pluginFile.Name()}}
 			m.Events = []EventType{PackageInstalled}
@@ -174,11 +220,8 @@ var _ = Describe("Plugin", func() {
 		})
 
 		It("gets multiple plugin responses", func() {
-			d1 := []byte("#!/bin/bash\nless <&0\n")
-			err := ioutil.WriteFile(pluginFile.Name(), d1, 0550)
-			Expect(err).Should(BeNil())
-			err = ioutil.WriteFile(pluginFile2.Name(), d1, 0550)
-			Expect(err).Should(BeNil())
+			writeScript(pluginFile, "less <&0")
+			writeScript(pluginFile2, "less <&0")
 
 			m.Plugins = []Plugin{{Name: "test", Executable: pluginFile.Name()},
 				{Name: "test2", Executable: pluginFile2.Name()}}
@@ -220,9 +263,7 @@ var _ = Describe("Plugin", func() {
 			Expect(receivedPlugin).To(ContainElement(&Plugin{Name: "test", Executable: pluginFile.Name()}))
 		})
 		It("is concurrent safe", func() {
-			d1 := []byte("#!/bin/bash\nless <&0\n")
-			err := ioutil.WriteFile(pluginFile.Name(), d1, 0550)
-			Expect(err).Should(BeNil())
+			writeScript(pluginFile, "less <&0")
 
 			m.Plugins = []Plugin{{Name: "test", Executable: pluginFile.Name()}}
 			m.Events = []EventType{PackageInstalled}
@@ -258,14 +299,289 @@ var _ = Describe("Plugin", func() {
 			mu.Unlock()
 		})
 
-		It("Writes the data to a file when it's too big", func() {
-			d1 := []byte(`#!/bin/bash
-echo "{ \"data\": \"$(less <&0 | base64 -w0)\" }"`)
-			err := ioutil.WriteFile(pluginFile.Name(), d1, 0550)
+		It("collects all the plugin responses", func() {
+			writeScript(pluginFile, "less <&0")
+			writeScript(pluginFile2, "exit 1")
+
+			m.Plugins = []Plugin{{Name: "test", Executable: pluginFile.Name()},
+				{Name: "test2", Executable: pluginFile2.Name()}}
+			m.Events = []EventType{PackageInstalled}
+			m.Register()
+
+			foo := map[string]string{"foo": "bar"}
+			results, err := m.PublishAndCollect(PackageInstalled, foo)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("plugin test2"))
+			Expect(err.Error()).ToNot(ContainSubstring("plugin test:"))
+
+			Expect(len(results)).To(Equal(2))
+			Expect(results[0].Plugin.Name).To(Equal("test"))
+			Expect(results[0].Error).ToNot(HaveOccurred())
+			var received map[string]string
+			Expect(results[0].Response.Unmarshal(&received)).To(Succeed())
+			Expect(received).To(Equal(foo))
+
+			Expect(results[1].Plugin.Name).To(Equal("test2"))
+			Expect(results[1].Error).To(HaveOccurred())
+			Expect(results[1].Response.Errored()).To(BeTrue())
+		})
+
+		It("keeps persistent plugins running", func() {
+			writeScript(pluginFile, `[ "$1" == "pluggable.serve" ] || exit 1
+while read -r line; do
+	id=$(echo "$line" | jq -r .id)
+	echo "{\"id\": $id, \"response\": {\"state\": \"$$\"}}"
+done`)
+
+			m.Plugins = []Plugin{{Name: "test", Executable: pluginFile.Name(), Persistent: true}}
+			m.Events = []EventType{PackageInstalled}
+			m.Register()
+			defer m.Close()
+
+			results, err := m.PublishAndCollect(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			pid := results[0].Response.State
+			Expect(pid).ToNot(BeEmpty())
+
+			results, err = m.PublishAndCollect(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results[0].Response.State).To(Equal(pid))
+
+			p, err := strconv.Atoi(pid)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(syscall.Kill(p, syscall.SIGKILL)).To(Succeed())
+
+			Eventually(func() string {
+				results, _ := m.PublishAndCollect(PackageInstalled, "foo")
+				return results[0].Response.State
+			}, 10*time.Second).ShouldNot(Or(Equal(pid), BeEmpty()))
+		})
+
+		It("times out persistent plugins which don't read their stdin", func() {
+			writeScript(pluginFile, "exec sleep 30")
+
+			m.Plugins = []Plugin{{Name: "test", Executable: pluginFile.Name(), Persistent: true, Timeout: 500 * time.Millisecond}}
+			m.Events = []EventType{PackageInstalled}
+			m.Register()
+			defer m.Close()
+
+			// The payload doesn't fit in the pipe buffer, so writing it blocks
+			payload := randStringRunes(1 << 20)
+			done := make(chan []PluginResult, 2)
+			for i := 0; i < 2; i++ {
+				go func() {
+					results, _ := m.PublishAndCollect(PackageInstalled, payload)
+					done <- results
+				}()
+			}
+			// Neither request stays blocked: one times out and kills
+			// the plugin, which fails the other if it is still pending
+			var states []string
+			for i := 0; i < 2; i++ {
+				var results []PluginResult
+				Eventually(done, 3*time.Second).Should(Receive(&results))
+				Expect(results[0].Error).To(HaveOccurred())
+				states = append(states, results[0].Response.State)
+			}
+			Expect(states).To(ContainElement(StateTimeout))
+		})
+
+		It("talks JSON-RPC with plugins", func() {
+			writeScript(pluginFile, `jq -c '{jsonrpc: "2.0", id: .id, result: .params}' <&0`)
+			writeScript(pluginFile2, `jq -c '{jsonrpc: "2.0", id: .id, error: {code: 42, message: .method}}' <&0`)
+
+			m.Plugins = []Plugin{{Name: "test", Executable: pluginFile.Name(), Protocol: ProtocolJSONRPC},
+				{Name: "test2", Executable: pluginFile2.Name(), Protocol: ProtocolJSONRPC}}
+			m.Events = []EventType{PackageInstalled}
+			m.Register()
+
+			foo := map[string]string{"foo": "bar"}
+			results, err := m.PublishAndCollect(PackageInstalled, foo)
+			Expect(err).To(HaveOccurred())
+
+			var received map[string]string
+			Expect(results[0].Error).ToNot(HaveOccurred())
+			Expect(results[0].Response.Unmarshal(&received)).To(Succeed())
+			Expect(received).To(Equal(foo))
+
+			var rpcErr *RPCError
+			Expect(errors.As(results[1].Error, &rpcErr)).To(BeTrue())
+			Expect(rpcErr.Code).To(Equal(42))
+			Expect(results[1].Response.Error).To(Equal(string(PackageInstalled)))
+			Expect(results[1].Response.Unhandled()).To(BeFalse())
+		})
+
+		It("maps JSON-RPC method not found errors to unhandled events", func() {
+			writeScript(pluginFile, `jq -c '{jsonrpc: "2.0", id: .id, error: {code: -32601, message: ("unhandled event " + .method)}}' <&0`)
+
+			m.Plugins = []Plugin{{Name: "test", Executable: pluginFile.Name(), Protocol: ProtocolJSONRPC}}
+			m.Events = []EventType{PackageInstalled}
+			m.Breaker = &CircuitBreaker{Threshold: 1, Cooldown: time.Minute}
+			m.Register()
+
+			for i := 0; i < 2; i++ {
+				results, _ := m.PublishAndCollect(PackageInstalled, "foo")
+				Expect(results[0].Response.Unhandled()).To(BeTrue())
+			}
+			Expect(m.Circuit(m.Plugins[0])).To(Equal(CircuitClosed))
+
+			d, err := m.Ask(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(d.Verdicts[0].Abstained).To(BeTrue())
+		})
+
+		It("passes JSON-RPC payloads of any type to factory handlers", func() {
+			captured := pluginFile2.Name()
+			writeScript(pluginFile, `tee "`+captured+`" | jq -c '{jsonrpc: "2.0", id: .id, result: {}}'`)
+			m.Plugins = []Plugin{{Name: "test", Executable: pluginFile.Name(), Protocol: ProtocolJSONRPC}}
+			m.Events = []EventType{PackageInstalled}
+			m.Register()
+
+			factory := NewPluginFactory()
+			factory.Add(PackageInstalled, func(e *Event) EventResponse {
+				return EventResponse{Data: e.Data}
+			})
+
+			for _, payload := range []interface{}{"bar", 42.0, true, []interface{}{"bar"}, []interface{}{}, map[string]interface{}{"foo": "bar"}} {
+				_, err := m.PublishAndCollect(PackageInstalled, payload)
+				Expect(err).ToNot(HaveOccurred())
+
+				req, err := os.Open(captured)
+				Expect(err).ToNot(HaveOccurred())
+				out := bytes.NewBufferString("")
+				Expect(factory.Run(PackageInstalled, req, out)).To(Succeed())
+				req.Close()
+
+				resp := struct {
+					Result struct{ Data string }
+				}{}
+				Expect(json.Unmarshal(out.Bytes(), &resp)).To(Succeed())
+				received := &Event{Data: resp.Result.Data}
+				var v interface{}
+				Expect(received.Unmarshal(&v)).To(Succeed())
+				Expect(v).To(Equal(payload))
+			}
+		})
+
+		It("subscribes plugins to the events they describe", func() {
+			writeScript(pluginFile, `if [ "$1" == "pluggable.describe" ]; then
+	echo '{ "data": "{\"name\": \"test\", \"protocolVersion\": 1, \"events\": [\"package.remove\"]}" }'
+else
+	echo '{ "state": "called" }'
+fi`)
+			writeScript(pluginFile2, `echo "{ \"state\": \"$1\" }"`)
+
+			m.Plugins = []Plugin{{Name: "test", Executable: pluginFile.Name()},
+				{Name: "test2", Executable: pluginFile2.Name()}}
+			m.Events = []EventType{PackageInstalled, "package.remove"}
+			m.Handshake = true
+			m.Register()
+
+			Expect(m.Plugins[0].Description).ToNot(BeNil())
+			Expect(m.Plugins[0].Events).To(Equal([]EventType{"package.remove"}))
+			Expect(m.Plugins[1].Description).To(BeNil())
+
+			results, err := m.PublishAndCollect(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(results)).To(Equal(1))
+			Expect(results[0].Plugin.Name).To(Equal("test2"))
+
+			results, err = m.PublishAndCollect("package.remove", "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(results)).To(Equal(2))
+			Expect(results[0].Response.State).To(Equal("called"))
+		})
+
+		It("applies descriptions to the right plugins when they change during the handshake", func() {
+			temp, err := ioutil.TempDir(os.TempDir(), "describe")
 			Expect(err).Should(BeNil())
+			defer os.RemoveAll(temp)
+
+			describing := func(event string, delay string) string {
+				return `if [ "$1" == "pluggable.describe" ]; then
+	sleep ` + delay + `
+	echo '{ "data": "{\"name\": \"test\", \"protocolVersion\": 1, \"events\": [\"` + event + `\"]}" }'
+fi`
+			}
+			m.Plugins = []Plugin{
+				{Name: "fast", Executable: writePlugin(temp, "fast", describing(string(PackageInstalled), "0"))},
+				{Name: "slow", Executable: writePlugin(temp, "slow", describing("package.remove", "1"))},
+			}
+			m.Events = []EventType{PackageInstalled, "package.remove"}
+			m.Handshake = true
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				m.Register()
+			}()
+			time.Sleep(300 * time.Millisecond)
+			Expect(m.RemovePlugin("fast")).To(BeTrue())
+			Eventually(done, 5*time.Second).Should(BeClosed())
+
+			Expect(len(m.Plugins)).To(Equal(1))
+			Expect(m.Plugins[0].Name).To(Equal("slow"))
+			Expect(m.Plugins[0].Events).To(Equal([]EventType{"package.remove"}))
+		})
+
+		It("kills plugins exceeding their timeout", func() {
+			writeScript(pluginFile, `sleep 30
+echo '{ "state": "done" }'`)
+
+			m.Plugins = []Plugin{{Name: "test", Executable: pluginFile.Name(), Timeout: 200 * time.Millisecond}}
+			m.Events = []EventType{PackageInstalled}
+			m.Register()
+
+			var resp *EventResponse
+			m.Response(PackageInstalled, func(p *Plugin, r *EventResponse) {
+				resp = r
+			})
+
+			start := time.Now()
+			m.Publish(PackageInstalled, map[string]string{"foo": "bar"})
+			Expect(time.Since(start)).To(BeNumerically("<", 10*time.Second))
+			Expect(resp.Errored()).To(BeTrue())
+			Expect(resp.State).To(Equal(StateTimeout))
+		})
+
+		It("uses the manager default timeout", func() {
+			writeScript(pluginFile, "sleep 30")
 
 			m.Plugins = []Plugin{{Name: "test", Executable: pluginFile.Name()}}
 			m.Events = []EventType{PackageInstalled}
+			m.Timeout = 200 * time.Millisecond
+			m.Register()
+
+			var resp *EventResponse
+			m.Response(PackageInstalled, func(p *Plugin, r *EventResponse) {
+				resp = r
+			})
+			m.Publish(PackageInstalled, map[string]string{"foo": "bar"})
+			Expect(resp.State).To(Equal(StateTimeout))
+		})
+
+		It("stops plugins when the context is cancelled", func() {
+			writeScript(pluginFile, "sleep 30")
+
+			p := Plugin{Name: "test", Executable: pluginFile.Name()}
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				time.Sleep(200 * time.Millisecond)
+				cancel()
+			}()
+
+			resp, err := p.RunContext(ctx, Event{Name: PackageInstalled})
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+			Expect(resp.Errored()).To(BeTrue())
+			Expect(resp.State).ToNot(Equal(StateTimeout))
+		})
+
+		It("Writes the data to a file when it's too big", func() {
+			writeScript(pluginFile, `echo "{ \"data\": \"$(less <&0 | base64 -w0)\" }"`)
+
+			m.Plugins = []Plugin{{Name: "test", Executable: pluginFile.Name(), Transport: TransportFile}}
+			m.Events = []EventType{PackageInstalled}
 			m.Register()
 
 			foo := map[string]string{"foo": randStringRunes((1 << 13) + 1)}
@@ -283,16 +599,13 @@ echo "{ \"data\": \"$(less <&0 | base64 -w0)\" }"`)
 		})
 
 		It("The file that is written has the event content", func() {
-			d1 := []byte(`#!/bin/bash
-			data="$(cat $(less <&0 | jq -r .file))"
+			writeScript(pluginFile, `			data="$(cat $(less <&0 | jq -r .file))"
 			jq --arg key0   'data' \
 			   --arg value0 "$data" \
 				'. | .[$key0]=$value0' \
 				<<<'{}'`)
-			err := ioutil.WriteFile(pluginFile.Name(), d1, 0550)
-			Expect(err).Should(BeNil())
 
-			m.Plugins = []Plugin{{Name: "test", Executable: pluginFile.Name()}}
+			m.Plugins = []Plugin{{Name: "test", Executable: pluginFile.Name(), Transport: TransportFile}}
 			m.Events = []EventType{PackageInstalled}
 			m.Register()
 
@@ -316,6 +629,15 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
+// writePlugin writes a bash plugin running the script in the directory,
+// replacing any existing one, and returns its path
+func writePlugin(dir, name, script string) string {
+	path := filepath.Join(dir, name)
+	os.Remove(path)
+	Expect(ioutil.WriteFile(path, []byte("#!/bin/bash\n"+strings.TrimSuffix(script, "\n")+"\n"), 0550)).To(Succeed())
+	return path
+}
+
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
 func randStringRunes(n int) string {
@@ -0,0 +1,126 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+const (
+	// StateAllow is the state plugins respond with to approve an operation
+	StateAllow = "allow"
+	// StateDeny is the state plugins respond with to reject an operation
+	StateDeny = "deny"
+)
+
+// PolicyMode describes how the verdicts of the plugins are combined into a decision
+type PolicyMode string
+
+const (
+	// PolicyAnyDeny denies the operation if any plugin denies it.
+	// The operation is allowed if no plugin responds with a verdict.
+	PolicyAnyDeny PolicyMode = ""
+	// PolicyMajority allows the operation if more plugins allow it than deny it.
+	// The operation is denied if no plugin responds with a verdict.
+	PolicyMajority PolicyMode = "majority"
+	// PolicyAllAllow allows the operation only if every plugin allows it.
+	// Plugins which don't respond with a verdict deny it, unless they don't handle the event.
+	// The operation is denied if no plugin allows it, including when there are no plugins.
+	PolicyAllAllow PolicyMode = "all"
+)
+
+// Policy configures how Ask reaches a decision
+type Policy struct {
+	Mode PolicyMode
+	// FailOpen makes plugins which fail or time out allow the operation.
+	// By default they deny it.
+	FailOpen bool
+}
+
+// Verdict is the answer of a plugin to Ask
+type Verdict struct {
+	Plugin Plugin
+	// Allowed is true if the plugin allows the operation
+	Allowed bool
+	// Abstained is true if the plugin didn't respond with StateAllow or StateDeny,
+	// or didn't handle the event
+	Abstained bool
+	// Reason is the data of the plugin response, or the error message if the plugin failed
+	Reason string
+	Error  error
+}
+
+// Decision is the outcome of Ask
+type Decision struct {
+	Allowed  bool
+	Verdicts []Verdict
+}
+
+// Reasons returns the reasons of the plugins which denied the operation
+func (d Decision) Reasons() []string {
+	var reasons []string
+	for _, v := range d.Verdicts {
+		if !v.Allowed && !v.Abstained && v.Reason != "" {
+			reasons = append(reasons, v.Plugin.Name+": "+v.Reason)
+		}
+	}
+	return reasons
+}
+
+// Ask publishes the event to the subscribed plugins, which respond with
+// StateAllow or StateDeny, and combines their verdicts with the Manager
+// Policy into a decision. Errors of the plugins are part of the decision,
+// the returned error is only about publishing the event.
+func (m *Manager) Ask(event EventType, obj interface{}) (Decision, error) {
+	ev, err := m.event(event, obj)
+	if err != nil {
+		return Decision{}, err
+	}
+	results, _ := m.collect(ev)
+
+	d := Decision{}
+	allows, denies, unhandled := 0, 0, 0
+	for _, r := range results {
+		v := Verdict{Plugin: r.Plugin, Reason: r.Response.Data, Error: r.Error}
+		switch {
+		case r.Response.Unhandled():
+			v.Abstained = true
+			unhandled++
+		case r.Error != nil:
+			v.Allowed = m.Policy.FailOpen
+			v.Reason = r.Error.Error()
+		case r.Response.State == StateAllow:
+			v.Allowed = true
+		case r.Response.State == StateDeny:
+			v.Allowed = false
+		default:
+			v.Abstained = true
+		}
+
+		if !v.Abstained {
+			if v.Allowed {
+				allows++
+			} else {
+				denies++
+			}
+		}
+		d.Verdicts = append(d.Verdicts, v)
+	}
+
+	switch m.Policy.Mode {
+	case PolicyMajority:
+		d.Allowed = allows > denies
+	case PolicyAllAllow:
+		d.Allowed = allows > 0 && allows == len(results)-unhandled
+	default:
+		d.Allowed = denies == 0
+	}
+	return d, nil
+}
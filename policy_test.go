@@ -0,0 +1,153 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "github.com/mudler/go-pluggable"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Policy", func() {
+	Context("asking plugins", func() {
+		var temp string
+		var m *Manager
+
+		plugin := func(name, script string) Plugin {
+			return Plugin{Name: name, Executable: writePlugin(temp, name, script)}
+		}
+
+		BeforeEach(func() {
+			var err error
+			temp, err = ioutil.TempDir(os.TempDir(), "policy")
+			Expect(err).Should(BeNil())
+			m = NewManager([]EventType{PackageInstalled})
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(temp)
+		})
+
+		It("denies if any plugin denies", func() {
+			m.Plugins = []Plugin{
+				plugin("allow", `echo '{ "state": "allow" }'`),
+				plugin("deny", `echo '{ "state": "deny", "data": "nope" }'`),
+				plugin("abstain", `echo '{}'`),
+			}
+			m.Register()
+
+			d, err := m.Ask(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(d.Allowed).To(BeFalse())
+			Expect(d.Reasons()).To(Equal([]string{"deny: nope"}))
+			Expect(d.Verdicts[2].Abstained).To(BeTrue())
+
+			m.Policy.Mode = PolicyMajority
+			d, err = m.Ask(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(d.Allowed).To(BeFalse())
+		})
+
+		It("supports majority and unanimity", func() {
+			m.Plugins = []Plugin{
+				plugin("allow", `echo '{ "state": "allow" }'`),
+				plugin("allow2", `echo '{ "state": "allow" }'`),
+				plugin("deny", `echo '{ "state": "deny" }'`),
+			}
+			m.Register()
+
+			m.Policy.Mode = PolicyMajority
+			d, err := m.Ask(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(d.Allowed).To(BeTrue())
+
+			m.Policy.Mode = PolicyAllAllow
+			d, err = m.Ask(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(d.Allowed).To(BeFalse())
+
+			m.RemovePlugin("deny")
+			d, err = m.Ask(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(d.Allowed).To(BeTrue())
+		})
+
+		DescribeTable("decides without verdicts",
+			func(mode PolicyMode, plugins bool, allowed bool) {
+				if plugins {
+					m.Plugins = []Plugin{
+						plugin("abstain", `echo '{}'`),
+						plugin("unhandled", `echo '{ "state": "unhandled", "error": "unhandled event" }'`),
+					}
+				}
+				m.Policy.Mode = mode
+				m.Register()
+
+				d, err := m.Ask(PackageInstalled, "foo")
+				Expect(err).ToNot(HaveOccurred())
+				for _, v := range d.Verdicts {
+					Expect(v.Abstained).To(BeTrue())
+				}
+				Expect(d.Allowed).To(Equal(allowed))
+			},
+			Entry("any deny, no plugins", PolicyAnyDeny, false, true),
+			Entry("any deny, abstaining plugins", PolicyAnyDeny, true, true),
+			Entry("majority, no plugins", PolicyMajority, false, false),
+			Entry("majority, abstaining plugins", PolicyMajority, true, false),
+			Entry("all allow, no plugins", PolicyAllAllow, false, false),
+			Entry("all allow, abstaining plugins", PolicyAllAllow, true, false),
+		)
+
+		It("abstains for plugins which don't handle the event", func() {
+			m.Plugins = []Plugin{
+				plugin("allow", `echo '{ "state": "allow" }'`),
+				plugin("unhandled", `echo '{ "state": "unhandled", "error": "unhandled event package.install" }'`),
+			}
+			m.Register()
+
+			d, err := m.Ask(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(d.Allowed).To(BeTrue())
+			Expect(d.Verdicts[1].Abstained).To(BeTrue())
+
+			m.Policy.Mode = PolicyAllAllow
+			d, err = m.Ask(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(d.Allowed).To(BeTrue())
+		})
+
+		It("maps failures with fail-open or fail-closed", func() {
+			m.Plugins = []Plugin{
+				plugin("allow", `echo '{ "state": "allow" }'`),
+				plugin("failing", `exit 1`),
+			}
+			m.Register()
+
+			d, err := m.Ask(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(d.Allowed).To(BeFalse())
+			Expect(d.Verdicts[1].Error).To(HaveOccurred())
+
+			m.Policy.FailOpen = true
+			d, err = m.Ask(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(d.Allowed).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,208 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// ErrQueueFull is returned when a plugin execution is rejected because the queue is full
+var ErrQueueFull = errors.New("plugin execution queue is full")
+
+var errPoolClosed = errors.New("manager is closed")
+
+// Backpressure describes what happens to executions when the queue is full
+type Backpressure string
+
+const (
+	// BackpressureBlock makes executions wait for room in the queue
+	BackpressureBlock Backpressure = ""
+	// BackpressureFail rejects executions with ErrQueueFull
+	BackpressureFail Backpressure = "fail"
+)
+
+// PoolStats describes the plugin executions of a Manager
+type PoolStats struct {
+	// Queued is the number of executions waiting to run
+	Queued int
+	// InFlight is the number of executions running
+	InFlight int
+}
+
+// pool runs plugin executions with a fixed number of workers fed by a bounded queue,
+// and limits the executions of each plugin. Without workers, executions run in
+// the caller goroutine.
+type pool struct {
+	jobs     chan func()
+	quit     chan struct{}
+	failFast bool
+
+	// closing guards closed, so no job is queued once the pool is stopped
+	closing sync.RWMutex
+	closed  bool
+
+	queued, inflight int64
+
+	perPlugin int
+	mu        sync.Mutex
+	slots     map[string]chan struct{}
+}
+
+func newPool(workers, queue, perPlugin int, bp Backpressure) *pool {
+	p := &pool{
+		quit:      make(chan struct{}),
+		failFast:  bp == BackpressureFail,
+		perPlugin: perPlugin,
+		slots:     map[string]chan struct{}{},
+	}
+	if workers > 0 {
+		p.jobs = make(chan func(), queue)
+		for i := 0; i < workers; i++ {
+			go p.work()
+		}
+	}
+	return p
+}
+
+func (p *pool) work() {
+	for {
+		select {
+		case job := <-p.jobs:
+			job()
+		case <-p.quit:
+			// Run what is left in the queue, as callers are waiting for it
+			for {
+				select {
+				case job := <-p.jobs:
+					job()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// slot returns the semaphore limiting the executions of the plugin, if any
+func (p *pool) slot(key string) chan struct{} {
+	if p.perPlugin <= 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.slots[key]
+	if !ok {
+		s = make(chan struct{}, p.perPlugin)
+		p.slots[key] = s
+	}
+	return s
+}
+
+// do runs fn for the plugin identified by key, and waits for it to complete
+func (p *pool) do(ctx context.Context, key string, fn func()) error {
+	atomic.AddInt64(&p.queued, 1)
+	dequeue := func() { atomic.AddInt64(&p.queued, -1) }
+
+	if s := p.slot(key); s != nil {
+		select {
+		case s <- struct{}{}:
+		case <-ctx.Done():
+			dequeue()
+			return ctx.Err()
+		}
+		defer func() { <-s }()
+	}
+
+	done := make(chan struct{})
+	job := func() {
+		dequeue()
+		atomic.AddInt64(&p.inflight, 1)
+		defer func() {
+			atomic.AddInt64(&p.inflight, -1)
+			close(done)
+		}()
+		fn()
+	}
+
+	if p.jobs == nil {
+		job()
+		return nil
+	}
+
+	if err := p.enqueue(ctx, job); err != nil {
+		dequeue()
+		return err
+	}
+	<-done
+	return nil
+}
+
+func (p *pool) enqueue(ctx context.Context, job func()) error {
+	p.closing.RLock()
+	defer p.closing.RUnlock()
+	if p.closed {
+		return errPoolClosed
+	}
+
+	if p.failFast {
+		select {
+		case p.jobs <- job:
+			return nil
+		default:
+			return ErrQueueFull
+		}
+	}
+	select {
+	case p.jobs <- job:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *pool) stats() PoolStats {
+	return PoolStats{
+		Queued:   int(atomic.LoadInt64(&p.queued)),
+		InFlight: int(atomic.LoadInt64(&p.inflight)),
+	}
+}
+
+// stop terminates the workers once the queued executions are done
+func (p *pool) stop() {
+	p.closing.Lock()
+	defer p.closing.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.quit)
+	}
+}
+
+// workers returns the Manager pool, creating it on first use
+func (m *Manager) workers() *pool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pool == nil {
+		m.pool = newPool(m.Concurrency, m.QueueSize, m.PluginConcurrency, m.Backpressure)
+	}
+	return m.pool
+}
+
+// Stats returns the number of plugin executions queued and running
+func (m *Manager) Stats() PoolStats {
+	return m.workers().stats()
+}
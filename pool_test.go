@@ -0,0 +1,90 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "github.com/mudler/go-pluggable"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Pool", func() {
+	Context("limiting plugin executions", func() {
+		var temp string
+		var m *Manager
+
+		plugin := func(name string) Plugin {
+			return Plugin{Name: name, Executable: writePlugin(temp, name, "sleep 0.5\necho '{ \"state\": \"done\" }'")}
+		}
+
+		BeforeEach(func() {
+			var err error
+			temp, err = ioutil.TempDir(os.TempDir(), "pool")
+			Expect(err).Should(BeNil())
+			m = NewManager([]EventType{PackageInstalled})
+		})
+
+		AfterEach(func() {
+			m.Close()
+			os.RemoveAll(temp)
+		})
+
+		It("queues executions beyond the concurrency limit", func() {
+			m.Plugins = []Plugin{plugin("a"), plugin("b"), plugin("c")}
+			m.Concurrency = 1
+			m.QueueSize = 10
+			m.Register()
+
+			done := make(chan error)
+			go func() {
+				_, err := m.PublishAndCollect(PackageInstalled, "foo")
+				done <- err
+			}()
+
+			Eventually(m.Stats).Should(Equal(PoolStats{Queued: 2, InFlight: 1}))
+			Consistently(func() int { return m.Stats().InFlight }, 1*time.Second).Should(BeNumerically("<=", 1))
+			Eventually(done, 5*time.Second).Should(Receive(BeNil()))
+			Expect(m.Stats()).To(Equal(PoolStats{}))
+		})
+
+		It("fails fast when the queue is full", func() {
+			m.Plugins = []Plugin{plugin("a"), plugin("b")}
+			m.Concurrency = 1
+			m.Backpressure = BackpressureFail
+			m.Register()
+
+			_, err := m.Publish(PackageInstalled, "foo")
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, ErrQueueFull)).To(BeTrue())
+		})
+
+		It("limits the executions of each plugin", func() {
+			m.Plugins = []Plugin{plugin("a")}
+			m.PluginConcurrency = 1
+			m.Register()
+
+			go m.Publish(PackageInstalled, "foo")
+			go m.Publish(PackageInstalled, "foo")
+
+			Eventually(m.Stats).Should(Equal(PoolStats{Queued: 1, InFlight: 1}))
+			Eventually(m.Stats, 5*time.Second).Should(Equal(PoolStats{}))
+		})
+	})
+})
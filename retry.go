@@ -0,0 +1,104 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// StateRetry is the state plugins can respond with to ask to be run again,
+// when a RetryPolicy applies
+const StateRetry = "retry"
+
+// RetryPolicy controls how failing plugin executions are retried
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a plugin is run at most, including
+	// the first one. Values lower than 2 disable retries.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between retries. Zero means no cap.
+	MaxBackoff time.Duration
+	// Multiplier grows the delay after each retry. Defaults to 2.
+	Multiplier float64
+	// Jitter is the fraction of the delay, between 0 and 1, which is randomized
+	Jitter float64
+
+	// Retryable decides if an execution is retried. Defaults to DefaultRetryable.
+	Retryable func(EventResponse, error) bool
+}
+
+// DefaultRetryable retries executions which failed, or whose plugin responded
+// with the retry state. Events the plugin doesn't handle are not retried.
+func DefaultRetryable(resp EventResponse, err error) bool {
+	return (err != nil && !resp.Unhandled()) || resp.State == StateRetry
+}
+
+func (r *RetryPolicy) retryable(resp EventResponse, err error) bool {
+	if r.Retryable != nil {
+		return r.Retryable(resp, err)
+	}
+	return DefaultRetryable(resp, err)
+}
+
+// backoff returns the delay before the given retry, starting from 1
+func (r *RetryPolicy) backoff(retry int) time.Duration {
+	multiplier := r.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+
+	d := float64(r.InitialBackoff) * math.Pow(multiplier, float64(retry-1))
+	if r.MaxBackoff > 0 && d > float64(r.MaxBackoff) {
+		d = float64(r.MaxBackoff)
+	}
+	if r.Jitter > 0 {
+		d -= d * math.Min(r.Jitter, 1) * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// retryPolicy returns the policy applying to the plugin, if any
+func (m *Manager) retryPolicy(p Plugin) *RetryPolicy {
+	if p.Retry != nil {
+		return p.Retry
+	}
+	return m.Retry
+}
+
+// retry runs the plugin, retrying it according to its RetryPolicy.
+// The response carries the number of attempts made.
+func (m *Manager) retry(ctx context.Context, p Plugin, e Event) (EventResponse, error) {
+	policy := m.retryPolicy(p)
+
+	for attempt := 1; ; attempt++ {
+		resp, err := m.run(ctx, p, e)
+		resp.Attempts = attempt
+		if policy == nil || attempt >= policy.MaxAttempts || !policy.retryable(resp, err) {
+			return resp, err
+		}
+
+		t := time.NewTimer(policy.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return resp, err
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/mudler/go-pluggable"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Retry", func() {
+	Context("with plugins failing transiently", func() {
+		var temp string
+		var m *Manager
+
+		BeforeEach(func() {
+			var err error
+			temp, err = ioutil.TempDir("", "retry")
+			Expect(err).Should(BeNil())
+
+			// The plugin asks to be retried twice, then succeeds
+			count := filepath.Join(temp, "count")
+			plugin := writePlugin(temp, "plugin", `count=$(cat "`+count+`" 2>/dev/null || echo 0)
+count=$((count+1))
+echo $count > "`+count+`"
+if [ $count -lt 3 ]; then
+	echo '{ "state": "retry" }'
+else
+	echo '{ "state": "ok" }'
+fi`)
+
+			m = NewManager([]EventType{PackageInstalled})
+			m.Plugins = []Plugin{{Name: "test", Executable: plugin}}
+		})
+
+		AfterEach(func() {
+			m.Close()
+			os.RemoveAll(temp)
+		})
+
+		It("doesn't retry by default", func() {
+			m.Register()
+			results, err := m.PublishAndCollect(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results[0].Response.State).To(Equal(StateRetry))
+			Expect(results[0].Response.Attempts).To(Equal(1))
+		})
+
+		It("retries with the manager policy", func() {
+			m.Retry = &RetryPolicy{MaxAttempts: 5, InitialBackoff: 10 * time.Millisecond, Jitter: 0.5}
+
+			m.Register()
+
+			var attempts int
+			m.Response(PackageInstalled, func(p *Plugin, r *EventResponse) {
+				attempts = r.Attempts
+			})
+
+			results, err := m.PublishAndCollect(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results[0].Response.State).To(Equal("ok"))
+			Expect(results[0].Response.Attempts).To(Equal(3))
+			Expect(attempts).To(Equal(3))
+		})
+
+		It("stops at the maximum attempts of the plugin policy", func() {
+			m.Retry = &RetryPolicy{MaxAttempts: 5}
+			m.Plugins[0].Retry = &RetryPolicy{MaxAttempts: 2}
+			m.Register()
+
+			results, err := m.PublishAndCollect(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results[0].Response.State).To(Equal(StateRetry))
+			Expect(results[0].Response.Attempts).To(Equal(2))
+		})
+
+		It("uses the predicate to decide what is retried", func() {
+			m.Retry = &RetryPolicy{MaxAttempts: 5, Retryable: func(r EventResponse, err error) bool {
+				return err != nil
+			}}
+			m.Register()
+
+			results, err := m.PublishAndCollect(PackageInstalled, "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results[0].Response.Attempts).To(Equal(1))
+		})
+	})
+})
@@ -0,0 +1,195 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Schema is a compiled JSON Schema
+type Schema struct {
+	schema *jsonschema.Schema
+}
+
+// CompileSchema compiles a JSON Schema. Remote references are not resolved.
+func CompileSchema(schema string) (*Schema, error) {
+	c := jsonschema.NewCompiler()
+	c.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("remote reference %s is not supported", s)
+	}
+	if err := c.AddResource("schema.json", strings.NewReader(schema)); err != nil {
+		return nil, errors.Wrap(err, "while reading schema")
+	}
+	s, err := c.Compile("schema.json")
+	if err != nil {
+		return nil, errors.Wrap(err, "while compiling schema")
+	}
+	return &Schema{schema: s}, nil
+}
+
+// MustCompileSchema is like CompileSchema, but panics if the schema is invalid
+func MustCompileSchema(schema string) *Schema {
+	s, err := CompileSchema(schema)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Violation is a part of the data not matching a schema
+type Violation struct {
+	// Path is the JSON pointer to the invalid value
+	Path    string
+	Message string
+}
+
+func (v Violation) String() string {
+	if v.Path == "" {
+		return v.Message
+	}
+	return v.Path + ": " + v.Message
+}
+
+// validate returns how the payload, in the given encoding, doesn't match the schema
+func (s *Schema) validate(encoding, data string, payload []byte) []Violation {
+	if isJSONEncoding(encoding) {
+		return s.violations(data)
+	}
+
+	var v interface{}
+	if err := decodePayload(encoding, data, payload, &v); err != nil {
+		return []Violation{{Message: "invalid payload: " + err.Error()}}
+	}
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return []Violation{{Message: "invalid payload: " + err.Error()}}
+	}
+	return s.violations(string(dat))
+}
+
+// violations returns how the JSON data doesn't match the schema
+func (s *Schema) violations(data string) []Violation {
+	d := json.NewDecoder(bytes.NewBufferString(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return []Violation{{Message: "invalid JSON: " + err.Error()}}
+	}
+
+	err := s.schema.Validate(v)
+	if err == nil {
+		return nil
+	}
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		return []Violation{{Message: err.Error()}}
+	}
+
+	var res []Violation
+	var leaves func(*jsonschema.ValidationError)
+	leaves = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) == 0 {
+			res = append(res, Violation{Path: e.InstanceLocation, Message: e.Message})
+		}
+		for _, c := range e.Causes {
+			leaves(c)
+		}
+	}
+	leaves(verr)
+	return res
+}
+
+// EventSchema holds the schemas of the data of an event, and of the data of
+// its responses. Nil schemas don't validate anything.
+type EventSchema struct {
+	Request  *Schema
+	Response *Schema
+}
+
+// ValidationError is returned for data not matching the schema of its event
+type ValidationError struct {
+	Event EventType
+	// Response is true when the data is from a plugin response
+	Response   bool
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	kind := "event"
+	if e.Response {
+		kind = "response"
+	}
+	v := make([]string, len(e.Violations))
+	for i := range e.Violations {
+		v[i] = e.Violations[i].String()
+	}
+	return fmt.Sprintf("invalid %s data for %s: %s", kind, e.Event, strings.Join(v, "; "))
+}
+
+// ValidateEvent validates the data of the event
+func (s EventSchema) ValidateEvent(e *Event) error {
+	if s.Request == nil {
+		return nil
+	}
+	if v := s.Request.validate(e.Encoding, e.Data, e.Payload); len(v) > 0 {
+		return &ValidationError{Event: e.Name, Violations: v}
+	}
+	return nil
+}
+
+// ValidateResponse validates the data of a response to the event.
+// Responses with errors or without data are not validated.
+func (s EventSchema) ValidateResponse(event EventType, r EventResponse) error {
+	if s.Response == nil || r.Errored() || !r.HasData() {
+		return nil
+	}
+	if v := s.Response.validate(r.Encoding, r.Data, r.Payload); len(v) > 0 {
+		return &ValidationError{Event: event, Response: true, Violations: v}
+	}
+	return nil
+}
+
+// Handler returns a PluginHandler validating the events before passing them to h.
+// Invalid events get a response with the validation error.
+func (s EventSchema) Handler(h PluginHandler) PluginHandler {
+	return func(e *Event) EventResponse {
+		if err := s.ValidateEvent(e); err != nil {
+			return EventResponse{Error: err.Error()}
+		}
+		return h(e)
+	}
+}
+
+// validateEvent validates the event against its schema in the Manager, if any
+func (m *Manager) validateEvent(e *Event) error {
+	if s, ok := m.Schemas[e.Name]; ok {
+		return s.ValidateEvent(e)
+	}
+	return nil
+}
+
+// validateResponse validates the response against its schema in the Manager, if any
+func (m *Manager) validateResponse(e *Event, r EventResponse) error {
+	if s, ok := m.Schemas[e.Name]; ok {
+		return s.ValidateResponse(e.Name, r)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+
+	. "github.com/mudler/go-pluggable"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Schemas", func() {
+	schema := EventSchema{
+		Request: MustCompileSchema(`{
+			"type": "object",
+			"properties": {"name": {"type": "string"}},
+			"required": ["name"]
+		}`),
+		Response: MustCompileSchema(`{
+			"type": "object",
+			"properties": {"installed": {"type": "boolean"}},
+			"required": ["installed"]
+		}`),
+	}
+
+	It("rejects invalid schemas", func() {
+		_, err := CompileSchema(`{"type": 1}`)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("validates events in the factory", func() {
+		h := schema.Handler(func(e *Event) EventResponse { return EventResponse{State: "ok"} })
+
+		e, err := NewEvent(PackageInstalled, map[string]string{"name": "foo"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(h(e).State).To(Equal("ok"))
+
+		e, err = NewEvent(PackageInstalled, map[string]int{"name": 1})
+		Expect(err).ToNot(HaveOccurred())
+		resp := h(e)
+		Expect(resp.State).To(BeEmpty())
+		Expect(resp.Error).To(ContainSubstring("/name"))
+	})
+
+	Context("publishing events", func() {
+		var temp string
+		var m *Manager
+
+		BeforeEach(func() {
+			var err error
+			temp, err = ioutil.TempDir("", "schema")
+			Expect(err).Should(BeNil())
+
+			// The plugin responds with the data it received
+			plugin := writePlugin(temp, "plugin", `jq -c '{state: "ok", data: .data}' <&0`)
+
+			m = NewManager([]EventType{PackageInstalled})
+			m.Schemas = map[EventType]EventSchema{PackageInstalled: schema}
+			m.Plugins = []Plugin{{Name: "test", Executable: plugin}}
+			m.Register()
+		})
+
+		AfterEach(func() {
+			m.Close()
+			os.RemoveAll(temp)
+		})
+
+		It("validates the events before publishing", func() {
+			calls := 0
+			m.Response(PackageInstalled, func(p *Plugin, r *EventResponse) { calls++ })
+
+			_, err := m.Publish(PackageInstalled, map[string]string{"foo": "bar"})
+			Expect(err).To(HaveOccurred())
+			var verr *ValidationError
+			Expect(errors.As(err, &verr)).To(BeTrue())
+			Expect(verr.Event).To(Equal(PackageInstalled))
+			Expect(verr.Response).To(BeFalse())
+			Expect(verr.Violations).ToNot(BeEmpty())
+			Expect(calls).To(Equal(0))
+		})
+
+		It("validates the responses of the plugins", func() {
+			results, err := m.PublishAndCollect(PackageInstalled, map[string]string{"name": "foo"})
+			Expect(err).To(HaveOccurred())
+			var verr *ValidationError
+			Expect(errors.As(results[0].Error, &verr)).To(BeTrue())
+			Expect(verr.Response).To(BeTrue())
+			Expect(results[0].Response.Errored()).To(BeTrue())
+
+			results, err = m.PublishAndCollect(PackageInstalled, map[string]interface{}{"name": "foo", "installed": true})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results[0].Response.State).To(Equal("ok"))
+		})
+	})
+})
@@ -0,0 +1,133 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Transport is the way event payloads are passed to the plugins
+type Transport string
+
+const (
+	// TransportInline passes the payload in the event written to the plugin stdin
+	TransportInline Transport = ""
+	// TransportStdin writes the payload to the plugin stdin right after the event,
+	// separated by a newline. The event has an empty payload, its Stream and Size
+	// fields tell where to read it from and its size in bytes.
+	TransportStdin Transport = "stdin"
+	// TransportFD writes the payload to an extra file descriptor inherited by
+	// the plugin, see PayloadFD. The event tells so like with TransportStdin.
+	TransportFD Transport = "fd"
+	// TransportFile is the legacy transport, which writes payloads larger than
+	// 8KB to a temporary file, only readable by the user, whose path is in the
+	// event File field.
+	TransportFile Transport = "file"
+)
+
+// PayloadFD is the file descriptor the payload is read from with TransportFD
+const PayloadFD = 3
+
+// validTransport returns an error if the transport is unknown
+func validTransport(t Transport) error {
+	switch t {
+	case TransportInline, TransportStdin, TransportFD, TransportFile:
+		return nil
+	}
+	return errors.Errorf("unknown transport %q", t)
+}
+
+// payload returns the encoded payload of the event
+func (e Event) payload() []byte {
+	if isJSONEncoding(e.Encoding) {
+		return []byte(e.Data)
+	}
+	return e.Payload
+}
+
+// setPayload sets the encoded payload of the event
+func (e *Event) setPayload(b []byte) {
+	if isJSONEncoding(e.Encoding) {
+		e.Data = string(b)
+	} else {
+		e.Payload = b
+	}
+}
+
+// detached returns a copy of the event without the payload, and the payload
+func (e Event) detached() (*Event, []byte) {
+	copy := e.Copy()
+	copy.Data, copy.Payload = "", nil
+	return copy, e.payload()
+}
+
+// writePayloadFile writes the payload to a file in a new private directory,
+// and returns its path and a function removing it
+func writePayloadFile(b []byte) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "pluggable")
+	if err != nil {
+		return "", func() {}, errors.Wrap(err, "while creating temporary directory")
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	path := filepath.Join(dir, "payload")
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		cleanup()
+		return "", func() {}, errors.Wrap(err, "while writing to temporary file")
+	}
+	return path, cleanup, nil
+}
+
+// readEvent decodes the event written to a plugin stdin, reading its payload
+// with the transport it was sent with
+func readEvent(b []byte, ev *Event) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if err := dec.Decode(ev); err != nil {
+		return err
+	}
+
+	switch {
+	case ev.Stream == TransportStdin:
+		rest := bytes.TrimPrefix(b[dec.InputOffset():], []byte("\n"))
+		if len(rest) < ev.Size {
+			return errors.Errorf("payload truncated: expected %d bytes, got %d", ev.Size, len(rest))
+		}
+		ev.setPayload(rest[:ev.Size])
+	case ev.Stream == TransportFD:
+		f := os.NewFile(PayloadFD, "payload")
+		if f == nil {
+			return errors.New("payload file descriptor is not available")
+		}
+		defer f.Close()
+		p, err := io.ReadAll(f)
+		if err != nil {
+			return errors.Wrap(err, "while reading payload")
+		}
+		ev.setPayload(p)
+	case ev.File != "":
+		p, err := os.ReadFile(ev.File)
+		if err != nil {
+			return err
+		}
+		ev.setPayload(p)
+	}
+	ev.Stream, ev.Size = "", 0
+	return nil
+}
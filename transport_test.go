@@ -0,0 +1,130 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	. "github.com/mudler/go-pluggable"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transports", func() {
+	large := map[string]string{"foo": strings.Repeat("a", (1<<13)+1)}
+	largeJSON, _ := json.Marshal(large)
+
+	It("reads streamed payloads in the factory", func() {
+		envelope, err := json.Marshal(Event{Name: "foo", Stream: TransportStdin, Size: len(largeJSON)})
+		Expect(err).ToNot(HaveOccurred())
+		in := bytes.NewBuffer(append(append(envelope, '\n'), largeJSON...))
+
+		factory := NewPluginFactory()
+		factory.Add("foo", func(e *Event) EventResponse {
+			return EventResponse{Data: e.Data, State: string(e.Stream)}
+		})
+		out := bytes.NewBufferString("")
+		Expect(factory.Run("foo", in, out)).To(Succeed())
+
+		resp := EventResponse{}
+		Expect(json.Unmarshal(out.Bytes(), &resp)).To(Succeed())
+		Expect(resp.Data).To(Equal(string(largeJSON)))
+		Expect(resp.State).To(BeEmpty())
+	})
+
+	Context("with plugins", func() {
+		var temp string
+		var m *Manager
+
+		BeforeEach(func() {
+			var err error
+			temp, err = ioutil.TempDir("", "transport")
+			Expect(err).Should(BeNil())
+			m = NewManager([]EventType{PackageInstalled})
+		})
+
+		AfterEach(func() {
+			m.Close()
+			os.RemoveAll(temp)
+		})
+
+		It("passes the payload inline by default", func() {
+			path := writePlugin(temp, "plugin", `jq -c '{state: .file, data: .data}' <&0`)
+			m.Plugins = []Plugin{{Name: "test", Executable: path}}
+			m.Register()
+
+			results, err := m.PublishAndCollect(PackageInstalled, large)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results[0].Response.State).To(BeEmpty())
+			Expect(results[0].Response.Data).To(Equal(string(largeJSON)))
+		})
+
+		It("streams the payload over stdin", func() {
+			path := writePlugin(temp, "plugin", `read -r event
+payload="$(cat)"
+jq -n -c --arg s "$(jq -r '.stream + ":" + (.size | tostring)' <<<"$event")" --arg p "$payload" '{state: $s, data: $p}'
+`)
+			m.Plugins = []Plugin{{Name: "test", Executable: path, Transport: TransportStdin}}
+			m.Register()
+
+			results, err := m.PublishAndCollect(PackageInstalled, large)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results[0].Response.State).To(Equal(fmt.Sprintf("stdin:%d", len(largeJSON))))
+			Expect(results[0].Response.Data).To(Equal(string(largeJSON)))
+		})
+
+		It("streams the payload over an extra file descriptor", func() {
+			path := writePlugin(temp, "plugin", `stream="$(jq -r .stream <&0)"
+payload="$(cat <&3)"
+jq -n -c --arg s "$stream" --arg p "$payload" '{state: $s, data: $p}'
+`)
+			m.Plugins = []Plugin{{Name: "test", Executable: path, Transport: TransportFD}}
+			m.Register()
+
+			results, err := m.PublishAndCollect(PackageInstalled, large)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results[0].Response.State).To(Equal("fd"))
+			Expect(results[0].Response.Data).To(Equal(string(largeJSON)))
+		})
+
+		It("doesn't block on plugins ignoring the payload file descriptor", func() {
+			path := writePlugin(temp, "plugin", `echo '{ "state": "ok" }'`)
+			m.Plugins = []Plugin{{Name: "test", Executable: path, Transport: TransportFD}}
+			m.Register()
+
+			results, err := m.PublishAndCollect(PackageInstalled, map[string]string{"foo": strings.Repeat("a", 1<<20)})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results[0].Response.State).To(Equal("ok"))
+		})
+
+		It("writes legacy files in a private directory", func() {
+			path := writePlugin(temp, "plugin", `file="$(jq -r .file <&0)"
+jq -n -c --arg s "$(stat -c %a "$file")" --arg d "$(stat -c %a "$(dirname "$file")")" '{state: $s, data: $d}'
+`)
+			m.Plugins = []Plugin{{Name: "test", Executable: path, Transport: TransportFile}}
+			m.Register()
+
+			results, err := m.PublishAndCollect(PackageInstalled, large)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results[0].Response.State).To(Equal("600"))
+			Expect(results[0].Response.Data).To(Equal("700"))
+		})
+	})
+})
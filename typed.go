@@ -0,0 +1,110 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import "github.com/pkg/errors"
+
+// EventDef is an event type whose payload is a Req, and whose plugins
+// respond with a Resp in the response data. Payloads and responses
+// are encoded with the codec negotiated with each plugin, JSON by default.
+type EventDef[Req, Resp any] struct {
+	Type EventType
+}
+
+// NewEventDef returns the definition of a typed event
+func NewEventDef[Req, Resp any](t EventType) EventDef[Req, Resp] {
+	return EventDef[Req, Resp]{Type: t}
+}
+
+// TypedResult is the outcome of running a plugin against a typed event,
+// with the response data decoded
+type TypedResult[Resp any] struct {
+	PluginResult
+	Data Resp
+}
+
+// TypedHandler handles a typed event in a plugin
+type TypedHandler[Req, Resp any] func(e *Event, req Req) (Resp, error)
+
+// Event returns a new event with the given payload
+func (d EventDef[Req, Resp]) Event(req Req) (*Event, error) {
+	return NewEvent(d.Type, req)
+}
+
+// Decode decodes the data of a response. Empty data decodes to the zero value.
+func (d EventDef[Req, Resp]) Decode(r EventResponse) (Resp, error) {
+	var resp Resp
+	if !r.HasData() {
+		return resp, nil
+	}
+	err := r.Unmarshal(&resp)
+	return resp, err
+}
+
+// Publish publishes the event with the Manager and waits for all the subscribed
+// plugins to complete, like PublishAndCollect. Failures to decode the response
+// data are reported as errors of the plugins.
+func (d EventDef[Req, Resp]) Publish(m *Manager, req Req) ([]TypedResult[Resp], error) {
+	ev, err := m.event(d.Type, req)
+	if err != nil {
+		return nil, err
+	}
+	results, _ := m.collect(ev)
+
+	typed := make([]TypedResult[Resp], len(results))
+	var errs MultiError
+	for i, r := range results {
+		typed[i].PluginResult = r
+		if r.Error == nil && !r.Response.Unhandled() {
+			data, err := d.Decode(r.Response)
+			if err != nil {
+				typed[i].Error = errors.Wrap(err, "while decoding response data")
+			}
+			typed[i].Data = data
+		}
+		if typed[i].Error != nil {
+			errs = append(errs, errors.Wrapf(typed[i].Error, "plugin %s", r.Plugin.Name))
+		}
+	}
+	return typed, errs.ErrorOrNil()
+}
+
+// Handler returns a PluginHandler decoding the event data in a Req and
+// encoding the Resp returned by h in the response data. Errors are
+// returned in the response.
+func (d EventDef[Req, Resp]) Handler(h TypedHandler[Req, Resp]) PluginHandler {
+	return func(e *Event) EventResponse {
+		var req Req
+		if e.Data != "" || len(e.Payload) > 0 {
+			if err := e.Unmarshal(&req); err != nil {
+				return EventResponse{Error: errors.Wrap(err, "while decoding event data").Error()}
+			}
+		}
+
+		resp, err := h(e, req)
+		if err != nil {
+			return EventResponse{Error: err.Error()}
+		}
+		r, err := e.Respond(resp)
+		if err != nil {
+			return EventResponse{Error: errors.Wrap(err, "while encoding response data").Error()}
+		}
+		return r
+	}
+}
+
+// Handle registers a typed handler for the event in the factory, see Handler
+func (d EventDef[Req, Resp]) Handle(f PluginFactory, h TypedHandler[Req, Resp]) {
+	f.Add(d.Type, d.Handler(h))
+}
@@ -0,0 +1,127 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/mudler/go-pluggable"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type sumRequest struct {
+	A int `json:"a"`
+	B int `json:"b"`
+}
+
+type sumResponse struct {
+	Sum int `json:"sum"`
+}
+
+var _ = Describe("Typed events", func() {
+	sum := NewEventDef[sumRequest, sumResponse]("math.sum")
+
+	It("decodes and encodes payloads in the factory", func() {
+		factory := NewPluginFactory()
+		sum.Handle(factory, func(e *Event, req sumRequest) (sumResponse, error) {
+			if req.A < 0 {
+				return sumResponse{}, errors.New("negative")
+			}
+			return sumResponse{Sum: req.A + req.B}, nil
+		})
+
+		run := func(req sumRequest) EventResponse {
+			e, err := sum.Event(req)
+			Expect(err).ToNot(HaveOccurred())
+			dat, err := json.Marshal(e)
+			Expect(err).ToNot(HaveOccurred())
+
+			b := bytes.NewBufferString("")
+			Expect(factory.Run(sum.Type, bytes.NewBuffer(dat), b)).To(Succeed())
+			resp := EventResponse{}
+			Expect(json.Unmarshal(b.Bytes(), &resp)).To(Succeed())
+			return resp
+		}
+
+		resp := run(sumRequest{A: 1, B: 2})
+		data, err := sum.Decode(resp)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data.Sum).To(Equal(3))
+
+		resp = run(sumRequest{A: -1})
+		Expect(resp.Error).To(Equal("negative"))
+	})
+
+	Context("publishing", func() {
+		var temp string
+		var m *Manager
+
+		BeforeEach(func() {
+			var err error
+			temp, err = ioutil.TempDir("", "typed")
+			Expect(err).Should(BeNil())
+
+			writePlugin(temp, "sum", `jq -c '{data: ({sum: (.data | fromjson | .a + .b)} | tojson)}' <&0`)
+			writePlugin(temp, "broken", `echo '{ "data": "not json" }'`)
+
+			m = NewManager([]EventType{sum.Type})
+			m.Plugins = []Plugin{{Name: "sum", Executable: filepath.Join(temp, "sum")}}
+		})
+
+		AfterEach(func() {
+			m.Close()
+			os.RemoveAll(temp)
+		})
+
+		It("returns the decoded responses", func() {
+			m.Register()
+			results, err := sum.Publish(m, sumRequest{A: 2, B: 3})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(results)).To(Equal(1))
+			Expect(results[0].Plugin.Name).To(Equal("sum"))
+			Expect(results[0].Data).To(Equal(sumResponse{Sum: 5}))
+		})
+
+		It("skips plugins which don't handle the event", func() {
+			path := writePlugin(temp, "unhandled", `echo '{ "state": "unhandled", "error": "unhandled event" }'`)
+			m.Plugins = append(m.Plugins, Plugin{Name: "unhandled", Executable: path})
+			m.Register()
+
+			results, err := sum.Publish(m, sumRequest{A: 2, B: 3})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(results)).To(Equal(2))
+			Expect(results[1].Response.Unhandled()).To(BeTrue())
+			Expect(results[1].Error).ToNot(HaveOccurred())
+		})
+
+		It("reports responses which can't be decoded", func() {
+			m.Plugins = append(m.Plugins, Plugin{Name: "broken", Executable: filepath.Join(temp, "broken")})
+			m.Register()
+
+			results, err := sum.Publish(m, sumRequest{A: 2, B: 3})
+			Expect(err).To(HaveOccurred())
+			Expect(len(results)).To(Equal(2))
+			Expect(results[0].Error).ToNot(HaveOccurred())
+			Expect(results[0].Data.Sum).To(Equal(5))
+			Expect(results[1].Error).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,150 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// watchDebounce is how long the watcher waits for changes to settle before rescanning
+const watchDebounce = 100 * time.Millisecond
+
+// Watch loads the plugins prefixed by 'prefix' in the given paths, and keeps watching
+// the paths until the context is done: plugins created, replaced or removed in the
+// paths are added to, replaced in or removed from the Manager, and subscribed or
+// unsubscribed from the events accordingly. Listeners bound with OnPluginAdded and
+// OnPluginRemoved are notified of the changes.
+//
+// As plugins change while the Manager is running, Plugins should not be accessed
+// directly once Watch is called.
+func (m *Manager) Watch(ctx context.Context, prefix string, paths ...string) error {
+	var dirs []string
+	for _, path := range paths {
+		if !filepath.IsAbs(path) {
+			rel, err := relativeToCwd(path)
+			if err != nil {
+				return err
+			}
+			path = rel
+		}
+		dirs = append(dirs, path)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "while creating watcher")
+	}
+	for _, d := range dirs {
+		if err := watcher.Add(d); err != nil {
+			watcher.Close()
+			return errors.Wrapf(err, "while watching %s", d)
+		}
+	}
+
+	w := &pluginWatcher{
+		m:      m,
+		prefix: fmt.Sprintf("%s-", prefix),
+		dirs:   dirs,
+		known:  map[string]time.Time{},
+	}
+	w.rescan()
+
+	go func() {
+		defer watcher.Close()
+		timer := time.NewTimer(watchDebounce)
+		timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				timer.Reset(watchDebounce)
+			case _, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+			case <-timer.C:
+				w.rescan()
+			}
+		}
+	}()
+	return nil
+}
+
+// pluginWatcher tracks the plugins loaded from watched directories
+type pluginWatcher struct {
+	m      *Manager
+	prefix string
+	dirs   []string
+	// known maps the executables loaded by the watcher to their modification time
+	known map[string]time.Time
+}
+
+// scan returns the valid plugin executables in the watched directories
+func (w *pluginWatcher) scan() map[string]time.Time {
+	found := map[string]time.Time{}
+	for _, d := range w.dirs {
+		matches, err := filepath.Glob(filepath.Join(d, w.prefix+"*"))
+		if err != nil {
+			continue
+		}
+		for _, ma := range matches {
+			if isManifest(ma) {
+				continue
+			}
+			info, err := os.Stat(ma)
+			if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+				continue
+			}
+			found[ma] = info.ModTime()
+		}
+	}
+	return found
+}
+
+// rescan reconciles the Manager plugins with the content of the watched directories
+func (w *pluginWatcher) rescan() {
+	found := w.scan()
+
+	for path, mtime := range w.known {
+		if t, ok := found[path]; ok && t.Equal(mtime) {
+			continue
+		}
+		// Removed or replaced
+		w.m.removePlugins(func(p Plugin) bool { return p.Executable == path })
+		delete(w.known, path)
+	}
+
+	for path, mtime := range found {
+		if _, ok := w.known[path]; ok {
+			continue
+		}
+		name := strings.TrimPrefix(filepath.Base(path), w.prefix)
+		if w.m.addPlugin(Plugin{Name: name, Executable: path}) {
+			w.known[path] = mtime
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright © 2020-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pluggable_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/mudler/go-pluggable"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watch", func() {
+	Context("watching plugin directories", func() {
+		var temp string
+		var m *Manager
+
+		BeforeEach(func() {
+			var err error
+			temp, err = ioutil.TempDir(os.TempDir(), "watch")
+			Expect(err).Should(BeNil())
+			m = NewManager([]EventType{PackageInstalled})
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(temp)
+		})
+
+		It("adds, replaces and removes plugins", func() {
+			writePlugin(temp, "test-foo", `echo '{ "state": "first" }'`)
+
+			var added, removed []string
+			mu := sync.Mutex{}
+			m.OnPluginAdded(func(p *Plugin) {
+				mu.Lock()
+				defer mu.Unlock()
+				added = append(added, p.Name)
+			})
+			m.OnPluginRemoved(func(p *Plugin) {
+				mu.Lock()
+				defer mu.Unlock()
+				removed = append(removed, p.Name)
+			})
+			m.Register()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			Expect(m.Watch(ctx, "test", temp)).To(Succeed())
+
+			states := func() []string {
+				results, _ := m.PublishAndCollect(PackageInstalled, "foo")
+				s := []string{}
+				for _, r := range results {
+					s = append(s, r.Plugin.Name+":"+r.Response.State)
+				}
+				return s
+			}
+			Expect(states()).To(Equal([]string{"foo:first"}))
+
+			writePlugin(temp, "test-bar", `echo '{ "state": "second" }'`)
+			Eventually(states, 5*time.Second).Should(ConsistOf("foo:first", "bar:second"))
+
+			Expect(os.Remove(filepath.Join(temp, "test-foo"))).To(Succeed())
+			Eventually(states, 5*time.Second).Should(Equal([]string{"bar:second"}))
+
+			// Make sure the modification time changes
+			time.Sleep(10 * time.Millisecond)
+			writePlugin(temp, "test-bar.new", `echo '{ "state": "third" }'`)
+			Expect(os.Rename(filepath.Join(temp, "test-bar.new"), filepath.Join(temp, "test-bar"))).To(Succeed())
+			Eventually(func() []string {
+				mu.Lock()
+				defer mu.Unlock()
+				return removed
+			}, 5*time.Second).Should(Equal([]string{"foo", "bar"}))
+			Eventually(func() []string {
+				mu.Lock()
+				defer mu.Unlock()
+				return added
+			}, 5*time.Second).Should(Equal([]string{"foo", "bar", "bar"}))
+			Expect(states()).To(Equal([]string{"bar:third"}))
+		})
+	})
+})